@@ -0,0 +1,410 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+  "text/tabwriter"
+  "encoding/json"
+  "database/sql"
+  "github.com/harrytruong/gtfs-sqlite/gtfsconv"
+)
+
+// commands: CLI subcommands, run against an already built sqlite db
+//           e.g., `gtfs-sqlite [options] search <term>`
+var commands = map[string]func(db *sql.DB, args []string) error{
+  "search": cmdSearch,
+  "nearby": cmdNearby,
+  "headways": cmdHeadways,
+  "plan": cmdPlan,
+  "isochrone": cmdIsochrone,
+  "od-matrix": cmdODMatrix,
+  "departures": cmdDepartures,
+}
+
+// runCommand opens the built sqlite db (see "-dir", "-name"),
+// with any extensions (see "-load-extension"),
+// and runs CLI subcommand with its args.
+func runCommand(name string, args []string) error {
+  db, oErr := gtfsconv.Open(gtfsconv.DBPath(opt), opt.Extensions...)
+  if oErr != nil {
+    return fmt.Errorf("gtfsconv.Open() %s", oErr)
+  }
+  defer db.Close()
+
+  return commands[name](db, args)
+}
+
+// newTabWriter Helper: tabwriter for CLI table output.
+func newTabWriter() *tabwriter.Writer {
+  return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+// cmdSearch: `search [-limit n] <term>`
+//            prints ranked stops/routes matching term.
+func cmdSearch(db *sql.DB, args []string) error {
+  fs := flag.NewFlagSet("search", flag.ExitOnError)
+  limit := fs.Int("limit", 20, "Max number of matches.")
+  fs.Parse(args)
+
+  results, sErr := gtfsconv.Search(db, strings.Join(fs.Args(), " "), *limit)
+  if sErr != nil {
+    return fmt.Errorf("gtfsconv.Search() %s", sErr)
+  }
+
+  w := newTabWriter()
+  fmt.Fprintln(w, "KIND\tID\tCODE\tNAME\tDESC")
+  for _, r := range results {
+    fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Kind, r.ID, r.Code, r.Name,
+      r.Description)
+  }
+
+  return w.Flush()
+}
+
+// cmdNearby: `nearby [-radius m] [-limit n] <lat> <lon>`
+//            prints stops within radius (in meters) of lat/lon.
+func cmdNearby(db *sql.DB, args []string) error {
+  fs := flag.NewFlagSet("nearby", flag.ExitOnError)
+  radius := fs.Float64("radius", 500, "Radius (in meters).")
+  limit := fs.Int("limit", 20, "Max number of stops.")
+  fs.Parse(args)
+
+  lat, latErr := strconv.ParseFloat(fs.Arg(0), 64)
+  lon, lonErr := strconv.ParseFloat(fs.Arg(1), 64)
+  if latErr != nil || lonErr != nil {
+    return fmt.Errorf("expected <lat> <lon> arguments")
+  }
+
+  stops, nErr := gtfsconv.NearbyStops(db, lat, lon, *radius, *limit)
+  if nErr != nil {
+    return fmt.Errorf("gtfsconv.NearbyStops() %s", nErr)
+  }
+
+  w := newTabWriter()
+  fmt.Fprintln(w, "STOP_ID\tNAME\tLAT\tLON\tDISTANCE")
+  for _, s := range stops {
+    fmt.Fprintf(w, "%s\t%s\t%f\t%f\t%.0fm\n",
+      s.StopID, s.Name, s.Lat, s.Lon, s.Distance)
+  }
+
+  return w.Flush()
+}
+
+// cmdHeadways: `headways [-day d] [-periods p] [-route id] [-direction d]
+//              [-stop id]`
+//              prints headways (in minutes) of routes at stops, on day.
+func cmdHeadways(db *sql.DB, args []string) error {
+  fs := flag.NewFlagSet("headways", flag.ExitOnError)
+  day := fs.String("day", "weekday",
+    "Service date (YYYYMMDD), or day type (weekday, saturday, sunday, ...).")
+  periods := fs.String("periods", opt.Periods,
+    "Time-of-day periods, as name=start-end,... (hours).")
+  route := fs.String("route", "", "Only this route_id.")
+  direction := fs.String("direction", "", "Only this direction_id.")
+  stop := fs.String("stop", "", "Only this stop_id.")
+  fs.Parse(args)
+
+  headways, hErr := gtfsconv.Headways(db, *day, *periods)
+  if hErr != nil {
+    return fmt.Errorf("gtfsconv.Headways() %s", hErr)
+  }
+
+  // minutes Helper: format seconds as minutes (or "-", if none)
+  minutes := func(secs float64, numTrips int) string {
+    if numTrips < 2 {
+      return "-"
+    }
+    return strconv.FormatFloat(secs / 60, 'f', 1, 64)
+  }
+
+  w := newTabWriter()
+  fmt.Fprintln(w, "DATE\tROUTE\tDIR\tSTOP\tPERIOD\tTRIPS\t" +
+    "MIN\tAVG\tMAX\tFIRST\tLAST")
+  for _, h := range headways {
+    if (*route != "" && h.RouteID != *route) ||
+      (*direction != "" && h.DirectionID != *direction) ||
+      (*stop != "" && h.StopID != *stop) {
+      continue
+    }
+    fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+      h.Date, h.RouteID, h.DirectionID, h.StopID, h.Period, h.NumTrips,
+      minutes(float64(h.MinHeadway), h.NumTrips),
+      minutes(h.AvgHeadway, h.NumTrips),
+      minutes(float64(h.MaxHeadway), h.NumTrips),
+      gtfsconv.FormatClock(h.FirstDeparture),
+      gtfsconv.FormatClock(h.LastDeparture))
+  }
+
+  return w.Flush()
+}
+
+// cmdPlan: `plan [-date d] [-time t] [-max-transfers n] [-max-walk m]
+//          [-walk-speed s] [-geojson] <from> <to>`
+//          prints itineraries from a stop (or "lat,lon") to another.
+func cmdPlan(db *sql.DB, args []string) error {
+  popt := gtfsconv.DefaultPlanOptions()
+  now := time.Now()
+
+  fs := flag.NewFlagSet("plan", flag.ExitOnError)
+  date := fs.String("date", now.Format("20060102"),
+    "Service date (YYYYMMDD), default today.")
+  clock := fs.String("time", now.Format("15:04:05"),
+    "Departure time (H:MM, or H:MM:SS), default now.")
+  fs.IntVar(&popt.MaxTransfers, "max-transfers", popt.MaxTransfers,
+    "Max transfers.")
+  fs.Float64Var(&popt.MaxWalk, "max-walk", popt.MaxWalk,
+    "Max walk (in meters), from/to coordinates.")
+  fs.Float64Var(&popt.WalkSpeed, "walk-speed", popt.WalkSpeed,
+    "Walking speed (in m/s).")
+  geojson := fs.Bool("geojson", false, "Print itineraries as GeoJSON.")
+  fs.Parse(args)
+
+  if fs.NArg() != 2 {
+    return fmt.Errorf("expected <from> <to> arguments (stop_id, or lat,lon)")
+  }
+  departure, tErr := gtfsconv.ParseClock(*clock)
+  if tErr != nil {
+    return fmt.Errorf("invalid time %q [%s]", *clock, tErr)
+  }
+
+  itineraries, pErr := gtfsconv.Plan(db, gtfsconv.ParsePlace(fs.Arg(0)),
+    gtfsconv.ParsePlace(fs.Arg(1)), *date, departure, popt)
+  if pErr != nil {
+    return fmt.Errorf("gtfsconv.Plan() %s", pErr)
+  }
+
+  if *geojson {
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(gtfsconv.ItinerariesGeoJSON(itineraries))
+  }
+
+  if len(itineraries) == 0 {
+    fmt.Println("No itineraries found.")
+    return nil
+  }
+
+  w := newTabWriter()
+  for i, it := range itineraries {
+    fmt.Fprintf(w, "ITINERARY %d\t%s\t%s\t%d min, %d transfers\n", i+1,
+      gtfsconv.FormatClock(it.Departure), gtfsconv.FormatClock(it.Arrival),
+      (it.Arrival - it.Departure + 59) / 60, it.Transfers)
+    for _, leg := range it.Legs {
+      route := ""
+      if leg.Mode == "transit" {
+        route = leg.RouteName
+        if leg.Headsign != "" {
+          route += " to " + leg.Headsign
+        }
+        if leg.ServiceDate != *date { // past midnight, of previous date
+          route += " (" + leg.ServiceDate + ")"
+        }
+      } else if leg.Distance > 0 {
+        route = fmt.Sprintf("%.0fm", leg.Distance)
+      }
+      fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s → %s\n",
+        gtfsconv.FormatClock(leg.Departure),
+        gtfsconv.FormatClock(leg.Arrival), leg.Mode, route, leg.FromName,
+        leg.ToName)
+    }
+  }
+
+  return w.Flush()
+}
+
+// cmdIsochrone: `isochrone [-date d] [-time t] [-bands m,...]
+//               [-max-transfers n] [-max-walk m] [-walk-speed s]
+//               [-geojson] <from>`
+//               prints stops reachable from a stop (or "lat,lon").
+func cmdIsochrone(db *sql.DB, args []string) error {
+  popt := gtfsconv.DefaultPlanOptions()
+  now := time.Now()
+
+  fs := flag.NewFlagSet("isochrone", flag.ExitOnError)
+  date := fs.String("date", now.Format("20060102"),
+    "Service date (YYYYMMDD), default today.")
+  clock := fs.String("time", now.Format("15:04:05"),
+    "Departure time (H:MM, or H:MM:SS), default now.")
+  bandList := fs.String("bands", "10,20,30",
+    "Time bands (in minutes), the largest is the max travel time.")
+  fs.IntVar(&popt.MaxTransfers, "max-transfers", popt.MaxTransfers,
+    "Max transfers.")
+  fs.Float64Var(&popt.MaxWalk, "max-walk", popt.MaxWalk,
+    "Max walk (in meters), from coordinates, and from stops (for polygons).")
+  fs.Float64Var(&popt.WalkSpeed, "walk-speed", popt.WalkSpeed,
+    "Walking speed (in m/s).")
+  geojson := fs.Bool("geojson", false,
+    "Print reachable stops, and polygons of each band, as GeoJSON.")
+  fs.Parse(args)
+
+  if fs.NArg() != 1 {
+    return fmt.Errorf("expected <from> argument (stop_id, or lat,lon)")
+  }
+  departure, tErr := gtfsconv.ParseClock(*clock)
+  if tErr != nil {
+    return fmt.Errorf("invalid time %q [%s]", *clock, tErr)
+  }
+
+  var bands []int
+  maxBand := 0
+  for _, b := range strings.Split(*bandList, ",") {
+    m, bErr := strconv.Atoi(strings.TrimSpace(b))
+    if bErr != nil || m <= 0 {
+      return fmt.Errorf("invalid band %q, expected minutes", b)
+    }
+    bands = append(bands, m)
+    if m > maxBand {
+      maxBand = m
+    }
+  }
+
+  stops, iErr := gtfsconv.Isochrone(db, gtfsconv.ParsePlace(fs.Arg(0)),
+    *date, departure, maxBand * 60, popt)
+  if iErr != nil {
+    return fmt.Errorf("gtfsconv.Isochrone() %s", iErr)
+  }
+
+  if *geojson {
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(gtfsconv.IsochroneGeoJSON(stops, bands, popt))
+  }
+
+  w := newTabWriter()
+  fmt.Fprintln(w, "STOP_ID\tNAME\tARRIVAL\tMINUTES\tTRANSFERS")
+  for _, s := range stops {
+    fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", s.StopID, s.Name,
+      gtfsconv.FormatClock(s.Arrival), (s.Duration + 59) / 60, s.Transfers)
+  }
+
+  return w.Flush()
+}
+
+// cmdODMatrix: `od-matrix [-date d] [-start t] [-end t] [-max-time m]
+//               [-stops id,...] [-max-transfers n] [-walk-speed s]
+//               [-csv file]`
+//               writes min travel times between stops, into "od_matrix"
+//               table, and a csv file.
+func cmdODMatrix(db *sql.DB, args []string) error {
+  oopt := gtfsconv.ODOptions{Plan: gtfsconv.DefaultPlanOptions(),
+    Workers: opt.Workers}
+
+  fs := flag.NewFlagSet("od-matrix", flag.ExitOnError)
+  date := fs.String("date", time.Now().Format("20060102"),
+    "Service date (YYYYMMDD), default today.")
+  start := fs.String("start", "7:00",
+    "Start of departure window (H:MM, or H:MM:SS).")
+  end := fs.String("end", "9:00",
+    "End of departure window (H:MM, or H:MM:SS).")
+  maxTime := fs.Int("max-time", 90,
+    "Max travel time (in minutes, 0 = none).")
+  stopList := fs.String("stops", "",
+    "Origin, and destination, stop ids (comma separated), default all served.")
+  fs.IntVar(&oopt.Plan.MaxTransfers, "max-transfers", oopt.Plan.MaxTransfers,
+    "Max transfers.")
+  fs.Float64Var(&oopt.Plan.WalkSpeed, "walk-speed", oopt.Plan.WalkSpeed,
+    "Walking speed (in m/s).")
+  csvFile := fs.String("csv", strings.Trim(opt.Dir, "/")+"/od_matrix.csv",
+    "Output csv file (empty = none).")
+  fs.Parse(args)
+
+  var sErr, eErr error
+  if oopt.Start, sErr = gtfsconv.ParseClock(*start); sErr != nil {
+    return fmt.Errorf("invalid start %q [%s]", *start, sErr)
+  }
+  if oopt.End, eErr = gtfsconv.ParseClock(*end); eErr != nil {
+    return fmt.Errorf("invalid end %q [%s]", *end, eErr)
+  }
+  oopt.MaxTravelTime = *maxTime * 60
+  for _, id := range strings.Split(*stopList, ",") {
+    if id = strings.TrimSpace(id); id != "" {
+      oopt.Stops = append(oopt.Stops, id)
+    }
+  }
+
+  pairs, mErr := gtfsconv.ODMatrix(db, *date, oopt)
+  if mErr != nil {
+    return fmt.Errorf("gtfsconv.ODMatrix() %s", mErr)
+  }
+
+  if wErr := gtfsconv.WriteODMatrix(db, pairs); wErr != nil {
+    return fmt.Errorf("gtfsconv.WriteODMatrix() %s", wErr)
+  }
+  if *csvFile != "" {
+    if cErr := gtfsconv.WriteODMatrixCSV(*csvFile, pairs); cErr != nil {
+      return fmt.Errorf("gtfsconv.WriteODMatrixCSV() %s", cErr)
+    }
+  }
+
+  fmt.Printf("%d stop pairs, into od_matrix table", len(pairs))
+  if *csvFile != "" {
+    fmt.Printf(" (and %s)", *csvFile)
+  }
+  fmt.Println()
+  return nil
+}
+
+// cmdDepartures: `departures [-date d] [-time t] [-n n] <stop_id>`
+//                prints next departures from a stop (or parent station).
+func cmdDepartures(db *sql.DB, args []string) error {
+  fs := flag.NewFlagSet("departures", flag.ExitOnError)
+  date := fs.String("date", "",
+    "Date (YYYYMMDD, in agency_timezone), default today.")
+  clock := fs.String("time", "",
+    "Time (H:MM, or H:MM:SS, e.g., 24:30 is after midnight), default now.")
+  n := fs.Int("n", 10, "Max departures.")
+  fs.Parse(args)
+
+  if fs.NArg() != 1 {
+    return fmt.Errorf("expected <stop_id> argument")
+  }
+
+  loc, lErr := gtfsconv.AgencyLocation(db)
+  if lErr != nil {
+    return fmt.Errorf("gtfsconv.AgencyLocation() %s", lErr)
+  }
+
+  // departure time (now, or date/time in agency timezone)
+  now := time.Now().In(loc)
+  at := now
+  if *date != "" || *clock != "" {
+    if *date == "" {
+      *date = now.Format("20060102")
+    }
+    if *clock == "" {
+      *clock = now.Format("15:04:05")
+    }
+    secs, tErr := gtfsconv.ParseClock(*clock)
+    if tErr != nil {
+      return fmt.Errorf("invalid time %q [%s]", *clock, tErr)
+    }
+    t, sErr := gtfsconv.ServiceTime(*date, secs, loc)
+    if sErr != nil {
+      return fmt.Errorf("gtfsconv.ServiceTime() %s", sErr)
+    }
+    at = t
+  }
+
+  departures, dErr := gtfsconv.NextDepartures(db, fs.Arg(0), at, *n)
+  if dErr != nil {
+    return fmt.Errorf("gtfsconv.NextDepartures() %s", dErr)
+  }
+
+  w := newTabWriter()
+  fmt.Fprintln(w, "TIME\tMIN\tROUTE\tHEADSIGN\tSTOP_ID\tTRIP_ID")
+  for _, d := range departures {
+    clock := d.Time.Format("15:04:05")
+    if d.Time.Format("20060102") != at.Format("20060102") {
+      clock = d.Time.Format("Jan 2 15:04:05")
+    }
+    fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", clock,
+      int(d.Time.Sub(at).Minutes()), d.RouteName, d.Headsign, d.StopID,
+      d.TripID)
+  }
+
+  return w.Flush()
+}
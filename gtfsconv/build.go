@@ -15,6 +15,9 @@ import (
   "bytes"
   "io"
   "io/ioutil"
+  "time"
+  "runtime"
+  "sync"
   "unicode/utf8"
 
   "database/sql"
@@ -28,9 +31,41 @@ type Options struct {
   Name        string  // output sqlite db name
   SkipExtras  bool    // skip extra output formats (*.csv, *.json, *.xml)
   Spatialite  bool    // include sqlite3 spatialite extension
+  SpatialiteExt string // spatialite extension path (default: probe names)
+  Extensions  []string // other sqlite3 extensions to load (path or name)
+  Geometry    bool    // include geometry tables without spatialite (geopackage)
 
   KeepDB      bool    // re-use existing sqlite db (skip creation), if exist
   SkipClean   bool    // skip agency-specific GTFS cleanup rules
+
+  Lenient     bool    // skip (and log) malformed GTFS rows, instead of failing
+  MaxErrors   int     // max skipped rows per GTFS file, if lenient (0 = no max)
+
+  StartDate   string  // limit derived service dates from "YYYYMMDD" (optional)
+  EndDate     string  // limit derived service dates until "YYYYMMDD" (optional)
+
+  ExpandFrequencies bool // expand frequency-based trips into each trip run
+  Interpolate bool    // interpolate missing stop_times (non-timepoint stops)
+  GenerateShapes bool // generate straight-line shapes, for trips without any
+  ProjectStops bool   // project stops onto shapes (fill shape_dist_traveled)
+  MaxStopOffset float64 // max distance of stops from shape (in meters)
+  ClusterStops float64 // cluster similarly named stops within radius (meters)
+  ClusterSimilarity float64 // min name similarity of clustered stops (0-1)
+  ClusterParents bool // synthesize parent stations of stop clusters
+  Footpaths   float64 // generate walking transfers within radius (meters)
+  WalkSpeed   float64 // walking speed (in m/s), for walking transfers
+  ScheduledEvents bool // build UTC scheduled events (requires date range)
+  Patterns    bool    // build trip patterns (distinct stop sequences)
+  Segments    bool    // build stop-to-stop segments (run times, speeds)
+  Headways    string  // build headways on service date, or day type
+  Periods     string  // time-of-day periods, "name=start-end,..." (hours)
+  Search      bool    // build full-text search index (requires fts5)
+
+  Workers     int     // max parallel workers (e.g., for routes_geo paths)
+
+  Simplify    float64 // shape simplification tolerance (in meters, 0 = none)
+  SimplifyMethod string // "dp" (douglas-peucker) or "vw" (visvalingam)
+  Precision   int     // coordinate decimals for exports (0 = full precision)
 }
 
 // Default options for Build
@@ -40,9 +75,41 @@ var defaultOptions = Options{
   Name:         "gtfs.sqlite",
   SkipExtras:   false,
   Spatialite:   false,
+  SpatialiteExt: "",
+  Extensions:   nil,
+  Geometry:     false,
 
   KeepDB:       false,
   SkipClean:    false,
+
+  Lenient:      false,
+  MaxErrors:    100,
+
+  StartDate:    "",
+  EndDate:      "",
+
+  ExpandFrequencies: false,
+  Interpolate:  false,
+  GenerateShapes: false,
+  ProjectStops: false,
+  MaxStopOffset: 100,
+  ClusterStops: 0,
+  ClusterSimilarity: 0.5,
+  ClusterParents: false,
+  Footpaths:    0,
+  WalkSpeed:    1.2,
+  ScheduledEvents: false,
+  Patterns:     false,
+  Segments:     false,
+  Headways:     "",
+  Periods:      "night=0-6,am_peak=6-9,midday=9-15,pm_peak=15-19,evening=19-24",
+  Search:       false,
+
+  Workers:      runtime.NumCPU(),
+
+  Simplify:     0,
+  SimplifyMethod: "dp",
+  Precision:    0,
 }
 
 // csvReadRowsLimit controls reading GTFS csv during `importGTFS()`
@@ -50,12 +117,26 @@ var defaultOptions = Options{
 //       See "SQLITE_MAX_COMPOUND_SELECT" @ sqlite.org/limits.html
 const csvReadRowsLimit = 500
 
-// sqliteGTFSDriverRegistered flag runs sql.Register() only once
-var sqliteGTFSDriverRegistered = false
+// sqliteGTFSDrivers: registered sqlite3_gtfs driver names, by tracking
+// flag and their (newline-joined) list of extensions
+var sqliteGTFSDrivers = map[string]string{}
+
+// spatialiteExtNames: spatialite extension names to probe, if not set
+// note: sqlite also tries each with ".so", ".dylib", ".dll" suffix
+var spatialiteExtNames = []string{
+  "mod_spatialite",   // spatialite 4.2+
+  "libspatialite",    // older spatialite
+  "/usr/local/lib/mod_spatialite",
+  "/opt/homebrew/lib/mod_spatialite",
+}
 
-// sqliteGTFSConns collects all the sqlite3_gtfs connections
+// sqliteGTFSConns collects the sqlite3_gtfs connections of tracking
+// drivers (i.e., of setupDB, for backing up the memory db into file)
 var sqliteGTFSConns = []*sqlite3.SQLiteConn{}
 
+// sqliteGTFSMu guards sqliteGTFSDrivers and sqliteGTFSConns
+var sqliteGTFSMu sync.Mutex
+
 // DefaultOptions returns Options with default values.
 func DefaultOptions() Options {
   return defaultOptions
@@ -89,7 +170,7 @@ func Build(opt Options, logger *log.Logger) error {
 
     // import GTFS data
     logger.Println("Importing GTFS...")
-    if iErr := importGTFS(db, gtfs); iErr != nil {
+    if iErr := importGTFS(db, gtfs, opt); iErr != nil {
       return fmt.Errorf("importGTFS() %s", iErr)
     }
 
@@ -101,12 +182,145 @@ func Build(opt Options, logger *log.Logger) error {
       }
     }
 
+    // if enabled, generate shapes (for trips without shapes)
+    if opt.GenerateShapes && hasDBTable(db, "trips") {
+      logger.Println("Generating shapes...")
+      if gsErr := generateShapes(db); gsErr != nil {
+        return fmt.Errorf("generateShapes() %s", gsErr)
+      }
+    }
+
+    // if enabled, project stops onto shapes (linear referencing)
+    if opt.ProjectStops && hasDBTable(db, "shapes") &&
+      hasDBTableCol(db, "trips", "shape_id") {
+      logger.Println("Projecting stops onto shapes...")
+      if psErr := projectStops(db, opt.MaxStopOffset); psErr != nil {
+        return fmt.Errorf("projectStops() %s", psErr)
+      }
+    }
+
+    // if enabled, cluster stops (and synthesize parent stations)
+    if opt.ClusterStops > 0 {
+      logger.Println("Clustering stops...")
+      if csErr := buildStopClusters(db, opt.ClusterStops,
+        opt.ClusterSimilarity, opt.ClusterParents); csErr != nil {
+        return fmt.Errorf("buildStopClusters() %s", csErr)
+      }
+    }
+
+    // if enabled, generate walking transfers (between nearby stops)
+    if opt.Footpaths > 0 {
+      logger.Println("Generating footpaths...")
+      if fpErr := buildFootpaths(db, opt.Footpaths, opt.WalkSpeed);
+        fpErr != nil {
+        return fmt.Errorf("buildFootpaths() %s", fpErr)
+      }
+    }
+
+    // build derived service dates
+    if hasDBTable(db, "calendar") || hasDBTable(db, "calendar_dates") {
+      logger.Println("Building service dates...")
+      if sdErr := buildServiceDates(db, opt.StartDate, opt.EndDate);
+        sdErr != nil {
+        return fmt.Errorf("buildServiceDates() %s", sdErr)
+      }
+    }
+
+    // if enabled, interpolate missing stop times
+    if opt.Interpolate {
+      logger.Println("Interpolating stop times...")
+      if isErr := interpolateStopTimes(db); isErr != nil {
+        return fmt.Errorf("interpolateStopTimes() %s", isErr)
+      }
+    }
+
+    // if enabled, expand frequency-based trips
+    if opt.ExpandFrequencies && hasDBTable(db, "frequencies") {
+      logger.Println("Expanding frequencies...")
+      if efErr := expandFrequencies(db); efErr != nil {
+        return fmt.Errorf("expandFrequencies() %s", efErr)
+      }
+    }
+
+    // if enabled, build trip patterns
+    if opt.Patterns {
+      logger.Println("Building patterns...")
+      if pErr := buildPatterns(db); pErr != nil {
+        return fmt.Errorf("buildPatterns() %s", pErr)
+      }
+    }
+
+    // if enabled, build stop-to-stop segments
+    if opt.Segments {
+      logger.Println("Building segments...")
+      periods, _ := parsePeriods(opt.Periods) // validated in prepare()
+      if sgErr := buildSegments(db, periods); sgErr != nil {
+        return fmt.Errorf("buildSegments() %s", sgErr)
+      }
+    }
+
+    // if enabled, build headways (on service date, or day type)
+    if opt.Headways != "" {
+      logger.Println("Building headways...")
+      if hwErr := buildHeadways(db, opt.Headways, opt.Periods); hwErr != nil {
+        return fmt.Errorf("buildHeadways() %s", hwErr)
+      }
+    }
+
+    // if enabled, build absolute (utc) scheduled events
+    if opt.ScheduledEvents {
+      logger.Println("Building scheduled events...")
+      if seErr := buildScheduledEvents(db); seErr != nil {
+        return fmt.Errorf("buildScheduledEvents() %s", seErr)
+      }
+    }
+
+    // create convenience views
+    logger.Println("Creating views...")
+    if vErr := createViews(db); vErr != nil {
+      return fmt.Errorf("createViews() %s", vErr)
+    }
+
+    // if enabled, build full-text search index
+    if opt.Search {
+      logger.Println("Building search index...")
+      if siErr := buildSearchIndex(db); siErr != nil {
+        return fmt.Errorf("buildSearchIndex() %s", siErr)
+      }
+    }
+
     // if enabled, build extra spatialite tables
     if opt.Spatialite {
       logger.Println("Building Spatialite...")
-      if spErr := buildSpatialite(db); spErr != nil {
+      if spErr := buildSpatialite(db, opt.Workers,
+        newShapeSimplifier(opt)); spErr != nil {
         return fmt.Errorf("buildSpatialite() %s", spErr)
       }
+
+      // report (not fatal) routes_geo failures
+      if hasDBTable(db, "routes_geo") {
+        if n, _ := countDBTable(db, "*",
+          "routes_geo where geom_error is not null"); n > 0 {
+          logger.Printf("Building Spatialite: %d routes_geo failed " +
+            "(see routes_geo.geom_error)", n)
+        }
+      }
+    }
+
+    // if enabled, build geometry tables (without spatialite)
+    if opt.Geometry {
+      logger.Println("Building Geometry...")
+      if geoErr := buildGeometry(db, newShapeSimplifier(opt)); geoErr != nil {
+        return fmt.Errorf("buildGeometry() %s", geoErr)
+      }
+    }
+
+    // build r*tree spatial indexes
+    if hasDBTable(db, "stops") {
+      logger.Println("Building R*Tree...")
+      if rtErr := buildRTree(db); rtErr != nil {
+        return fmt.Errorf("buildRTree() %s", rtErr)
+      }
     }
 
     return nil
@@ -133,7 +347,7 @@ func Build(opt Options, logger *log.Logger) error {
 
     // export geojson based sqlite db
     logger.Println("Exporting GeoJSON...")
-    if geojsonErr := exportGeoJSON(opt.Dir, db);
+    if geojsonErr := exportGeoJSON(opt.Dir, db, newShapeSimplifier(opt));
       geojsonErr != nil {
       return fmt.Errorf("exportGeoJSON() %s", geojsonErr)
     }
@@ -153,17 +367,81 @@ func GoBuild(opt Options) error {
   return Build(opt, logger)
 }
 
+// DBPath returns the path of the sqlite db, within the output dir.
+func DBPath(opt Options) string {
+  return strings.Trim(opt.Dir, "/")+"/"+opt.Name
+}
+
 // prepare: reviews options for build.
 func prepare(opt *Options) error {
 
+  opt.Name = DBPath(*opt) // ensure db within dir
   opt.Dir = strings.Trim(opt.Dir, "/")+"/"  // ensure dir trailing slash
-  opt.Name = opt.Dir+opt.Name // ensure db within dir
 
   // ensure GTFS path is set
   if opt.GTFS == "" {
     return fmt.Errorf("missing gtfsFile (URL or path/to/gtfs.zip)")
   }
 
+  // ensure valid date range (GTFS "YYYYMMDD")
+  for _, d := range [...]string{opt.StartDate, opt.EndDate} {
+    if _, dErr := time.Parse("20060102", d); d != "" && dErr != nil {
+      return fmt.Errorf("invalid date %q, expected YYYYMMDD", d)
+    }
+  }
+  if opt.StartDate != "" && opt.EndDate != "" && opt.StartDate > opt.EndDate {
+    return fmt.Errorf("invalid date range, %s is after %s",
+      opt.StartDate, opt.EndDate)
+  }
+
+  // ensure one kind of geometry tables (same table names)
+  if opt.Spatialite && opt.Geometry {
+    return fmt.Errorf("spatialite and geometry options are exclusive")
+  }
+
+  // ensure valid shape simplification
+  if opt.SimplifyMethod != "dp" && opt.SimplifyMethod != "vw" {
+    return fmt.Errorf("invalid simplify method %q, expected dp or vw",
+      opt.SimplifyMethod)
+  }
+  if opt.Simplify < 0 || opt.Precision < 0 {
+    return fmt.Errorf("invalid simplify tolerance, or precision")
+  }
+
+  // ensure valid stop clustering
+  if opt.ClusterStops < 0 ||
+    opt.ClusterSimilarity < 0 || opt.ClusterSimilarity > 1 {
+    return fmt.Errorf("invalid cluster radius, or similarity (0 to 1)")
+  }
+
+  // ensure valid walking transfers
+  if opt.Footpaths < 0 || opt.WalkSpeed <= 0 {
+    return fmt.Errorf("invalid footpaths radius, or walk speed")
+  }
+
+  // ensure valid time-of-day periods
+  if _, pErr := parsePeriods(opt.Periods); pErr != nil {
+    return fmt.Errorf("parsePeriods() %s", pErr)
+  }
+
+  // ensure valid headways day (service date, or day type)
+  if opt.Headways != "" && isDayType(opt.Headways) == false {
+    return fmt.Errorf("invalid headways day %q, expected YYYYMMDD, " +
+      "weekday, saturday, sunday (or monday, ...)", opt.Headways)
+  }
+
+  // ensure fts5 is compiled in, for search index (before any build)
+  if opt.Search {
+    if fErr := probeFTS5(); fErr != nil {
+      return fmt.Errorf("probeFTS5() %s", fErr)
+    }
+  }
+
+  // ensure date range for scheduled events (too many, otherwise)
+  if opt.ScheduledEvents && (opt.StartDate == "" || opt.EndDate == "") {
+    return fmt.Errorf("scheduled events require a start and end date")
+  }
+
   // ensure dir exists
   if mkdirErr := os.MkdirAll(opt.Dir, 0777); mkdirErr != nil {
     return fmt.Errorf("could not create dir [%s]", mkdirErr)
@@ -238,27 +516,17 @@ func getGTFS(path string) (*zip.Reader, error) {
 // runs a callback setupFn(), and then optimizes the final db.
 // note: remember to call db.Close() when finished!
 func setupDB(opt Options, setupFn func(*sql.DB)error) (*sql.DB, error) {
-  dbexts := []string{}
+  dbexts := append([]string{}, opt.Extensions...)
 
   if opt.Spatialite { // add spatialite extension, if enabled
-    dbexts = append(dbexts, "libspatialite") // must exist on host system!
+    spatialite, pErr := probeSpatialite(opt.SpatialiteExt)
+    if pErr != nil {
+      return nil, fmt.Errorf("probeSpatialite() %s", pErr)
+    }
+    dbexts = append([]string{spatialite}, dbexts...)
   }
 
-  // register a custom sqlite3 driver,
-  // with additional extensions, and
-  // hook to access all connections
-  if sqliteGTFSDriverRegistered == false {
-    sql.Register("sqlite3_gtfs",
-      &sqlite3.SQLiteDriver{
-        Extensions: dbexts,
-        ConnectHook: func(conn *sqlite3.SQLiteConn) error {
-          sqliteGTFSConns = append(sqliteGTFSConns, conn)
-          return nil
-        },
-      })
-
-    sqliteGTFSDriverRegistered = true
-  }
+  driver := registerDriver(dbexts, true)
 
   // set default db target to ":memory:"
   target := ":memory:"
@@ -270,14 +538,16 @@ func setupDB(opt Options, setupFn func(*sql.DB)error) (*sql.DB, error) {
   }
 
   // open db connection
-  db, oErr := sql.Open("sqlite3_gtfs", target)
+  db, oErr := sql.Open(driver, target)
   if oErr != nil {
     return nil, fmt.Errorf("sql.Open() %s", oErr)
   }
-  db.Ping() // actually makes connection
+  if pErr := db.Ping(); pErr != nil { // actually makes connection
+    return nil, fmt.Errorf("db.Ping() %s", pErr)
+  }
 
   // reference to the current db connection
-  dbConn := sqliteGTFSConns[len(sqliteGTFSConns)-1]
+  dbConn := lastGTFSConn()
 
   // run setup callback function to setup db
   if fnErr := setupFn(db); fnErr != nil {
@@ -291,14 +561,16 @@ func setupDB(opt Options, setupFn func(*sql.DB)error) (*sql.DB, error) {
   if opt.KeepDB == false {
 
     // open a new connection to the destination file
-    fileDB, foErr := sql.Open("sqlite3_gtfs", opt.Name)
+    fileDB, foErr := sql.Open(driver, opt.Name)
     if foErr != nil {
       return nil, fmt.Errorf("sql.Open() %s", foErr)
     }
-    fileDB.Ping() // actually make connection
+    if fpErr := fileDB.Ping(); fpErr != nil { // actually make connection
+      return nil, fmt.Errorf("fileDB.Ping() %s", fpErr)
+    }
 
     // reference to the new file db connection
-    fileDBConn := sqliteGTFSConns[len(sqliteGTFSConns)-1]
+    fileDBConn := lastGTFSConn()
 
     // proceed with backup
   	backup, bErr := fileDBConn.Backup("main", dbConn, "main")
@@ -319,8 +591,110 @@ func setupDB(opt Options, setupFn func(*sql.DB)error) (*sql.DB, error) {
   return db, nil
 }
 
+// registerDriver registers a custom "sqlite3_gtfs" driver (once for each
+// list of extensions), with additional extensions, custom GTFS sql
+// functions, and (if track) hook to collect its connections (see
+// sqliteGTFSConns). Returns driver name.
+func registerDriver(dbexts []string, track bool) string {
+  sqliteGTFSMu.Lock()
+  defer sqliteGTFSMu.Unlock()
+
+  key := fmt.Sprintf("%t\n%s", track, strings.Join(dbexts, "\n"))
+  if name, ok := sqliteGTFSDrivers[key]; ok {
+    return name
+  }
+
+  name := "sqlite3_gtfs"
+  if len(sqliteGTFSDrivers) > 0 {
+    name = fmt.Sprintf("sqlite3_gtfs_%d", len(sqliteGTFSDrivers))
+  }
+
+  sql.Register(name,
+    &sqlite3.SQLiteDriver{
+      Extensions: dbexts,
+      ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+        if rfErr := registerFunctions(conn); rfErr != nil {
+          return fmt.Errorf("registerFunctions() %s", rfErr)
+        }
+
+        if track {
+          sqliteGTFSMu.Lock()
+          sqliteGTFSConns = append(sqliteGTFSConns, conn)
+          sqliteGTFSMu.Unlock()
+        }
+        return nil
+      },
+    })
+
+  sqliteGTFSDrivers[key] = name
+  return name
+}
+
+// lastGTFSConn Helper: The most recent connection of tracking drivers
+// (see registerDriver).
+func lastGTFSConn() *sqlite3.SQLiteConn {
+  sqliteGTFSMu.Lock()
+  defer sqliteGTFSMu.Unlock()
+  return sqliteGTFSConns[len(sqliteGTFSConns)-1]
+}
+
+// probeSpatialite Helper: Determine the loadable spatialite extension,
+// trying ext (if set), otherwise each of spatialiteExtNames.
+func probeSpatialite(ext string) (string, error) {
+  names := spatialiteExtNames
+  if ext != "" {
+    names = []string{ext}
+  }
+
+  var tried []string
+  for _, name := range names {
+
+    // try to connect with (only) this extension
+    db, oErr := sql.Open(registerDriver([]string{name}, false), ":memory:")
+    if oErr != nil {
+      return "", fmt.Errorf("sql.Open() %s", oErr)
+    }
+    pErr := db.Ping()
+    db.Close()
+
+    if pErr == nil {
+      return name, nil
+    }
+    tried = append(tried, fmt.Sprintf("%s [%s]", name, pErr))
+  }
+
+  return "", fmt.Errorf("failed to load spatialite extension, tried: %s",
+    strings.Join(tried, ", "))
+}
+
+// Open opens an existing sqlite db (e.g., built by Build), with custom
+// GTFS sql functions available (see registerFunctions), and with any
+// extensions (e.g., "mod_spatialite") loaded on each connection.
+// note: remember to call db.Close() when finished!
+func Open(name string, extensions ...string) (*sql.DB, error) {
+  if isExistFile(name) == false {
+    return nil, fmt.Errorf("sqlite db does not exist [%s]", name)
+  }
+
+  db, oErr := sql.Open(registerDriver(extensions, false), name)
+  if oErr != nil {
+    return nil, fmt.Errorf("sql.Open() %s", oErr)
+  }
+
+  if pErr := db.Ping(); pErr != nil {
+    db.Close()
+    return nil, fmt.Errorf("db.Ping() %s", pErr)
+  }
+
+  return db, nil
+}
+
 // importGTFS creates tables based on GTFS data.
-func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
+// note: if opt.Lenient, malformed rows are skipped
+//       and logged into "gtfs_import_errors" table.
+// note: GTFS time columns also get derived integer "*_secs"
+//       columns (see importTimeColumns), invalid times are logged.
+func importGTFS(db *sql.DB, gtfs *zip.Reader, opt Options) error {
 
   // ensure gtfs_metadata table
   if hasDBTable(db, "gtfs_metadata") == false {
@@ -331,6 +705,15 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
     }
   }
 
+  // ensure gtfs_import_errors table
+  if hasDBTable(db, "gtfs_import_errors") == false {
+    if _, ceErr := db.Exec("create table gtfs_import_errors " +
+      "(filename text, line integer, raw text, reason text, logged_at text);");
+      ceErr != nil {
+      return fmt.Errorf("failed to create gtfs_import_errors table [%s]", ceErr)
+    }
+  }
+
   // begin directly importing each GTFS file (csv)
   for _, f := range gtfs.File {
     if valid, _ := isGTFS(f.Name); valid == false {
@@ -347,16 +730,25 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
       case ims > 0: continue // skip importing file
     }
 
+    // clear errors logged by any previous (incomplete) import
+    if _, deErr := db.Exec(
+      "delete from gtfs_import_errors where filename = ?;", f.Name);
+      deErr != nil {
+      return fmt.Errorf("failed to clear prev %s errors [%s]", f.Name, deErr)
+    }
+
     fr, oErr := f.Open()
     if oErr != nil {
       return fmt.Errorf("failed to open %s file [%s]", f.Name, oErr)
     }
 
-    cr := csv.NewReader(fr)
+    rr := &rawReader{r: fr} // retains raw text, for error logging
+    cr := csv.NewReader(rr)
     header, hErr := cr.Read()
     if hErr != nil {
       return fmt.Errorf("failed to read %s file [%s]", f.Name, hErr)
     }
+    rr.text(0, cr.InputOffset()) // release header text
 
     // trim whitespace from each header
     for i, v := range header {
@@ -366,11 +758,28 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
       header[i] = strings.TrimSpace(v)
     }
 
+    // determine derived "seconds" columns for GTFS time columns
+    var timeCols []int       // index of time column in header
+    var secsCols []string    // name of derived column
+    for _, tc := range importTimeColumns[tablename] {
+      for i, h := range header {
+        if h == tc[0] && isStrIn(tc[1], header) == false {
+          timeCols = append(timeCols, i)
+          secsCols = append(secsCols, tc[1])
+        }
+      }
+    }
+    columns := append(append([]string{}, header...), secsCols...)
+
     // prepare create table statement
+    colDefs := strings.Join(header, " text, ") + " text"
+    for _, sc := range secsCols {
+      colDefs += ", " + sc + " integer"
+    }
     ctStmt := fmt.Sprintf(
       "drop table if exists %s; " +
-      "create table %s (%s text);", tablename,
-      tablename, strings.Join(header, " text, "))
+      "create table %s (%s);", tablename,
+      tablename, colDefs)
 
     // ensure valid utf8
     if utf8.ValidString(ctStmt) == false {
@@ -386,30 +795,93 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
     cr.TrimLeadingSpace = true // cleanup whitespace
     cr.LazyQuotes = true // allow weirdly placed (unescaped) quotes
 
+    // if lenient, quote errors are logged (instead of lazily swallowing
+    // the following rows into a field), see skipRow
+    if opt.Lenient {
+      cr.LazyQuotes = false
+    }
+
+    // skipRow handles a malformed row: unless lenient, fail the import;
+    // otherwise, log the row into "gtfs_import_errors" and skip it
+    numErrors := 0
+    skipRow := func(line int, raw, reason string) error {
+      if opt.Lenient == false {
+        return fmt.Errorf("failed to read %s file on line %d [%s]",
+          f.Name, line, reason)
+      }
+
+      if lErr := logImportError(db, f.Name, line, raw, reason); lErr != nil {
+        return fmt.Errorf("logImportError() %s", lErr)
+      }
+
+      numErrors++
+      if opt.MaxErrors > 0 && numErrors > opt.MaxErrors {
+        return fmt.Errorf("too many errors in %s file (max %d), " +
+          "last on line %d [%s]", f.Name, opt.MaxErrors, line, reason)
+      }
+
+      return nil
+    }
+
+    // insertRows inserts sql-insert-ready values into table
+    insertRows := func(values []string) error {
+      cleanValuesStr := strings.Join(values, ", ")
+      cleanValuesStr = strings.Replace(cleanValuesStr, `'`, `''`, -1)
+      cleanValuesStr = strings.Replace(cleanValuesStr, `#!`, `'`, -1)
+      _, itErr := db.Exec(fmt.Sprintf(
+        "insert into %s (%s) values %s;",
+        tablename,
+        strings.Join(columns, ", "),
+        cleanValuesStr))
+      return itErr
+    }
+
     // ... prepare row values and insert
     //     into table (500 rows at a time)
     //     until end of file (EOF)
     isEOF := false
     for isEOF == false {
-      values := make([]string, csvReadRowsLimit)
+      values := make([]string, 0, csvReadRowsLimit)
+      lines := make([]int, 0, csvReadRowsLimit) // line number, per value
+      raws := make([]string, 0, csvReadRowsLimit) // raw csv text, per value
 
       // read rows from csv until csvReadRowsLimit,
       // or until reached EOF
-      for i := 0; i < csvReadRowsLimit; i++ {
+      for len(values) < csvReadRowsLimit {
+        offset := cr.InputOffset()
         r, crErr := cr.Read()
+        raw := rr.text(offset, cr.InputOffset())
         if crErr != nil {
 
-          // if we hit EOF, trim rows and
-          // break from reading
+          // if we hit EOF, stop reading
           if crErr == io.EOF {
-            values = values[:i]
             isEOF = true
             break
           }
 
+          // malformed csv row, skip (if lenient)
+          if pe, ok := crErr.(*csv.ParseError); ok {
+            if sErr := skipRow(pe.StartLine, raw, pe.Err.Error());
+              sErr != nil {
+              return sErr
+            }
+            continue
+          }
+
           // otherwise, log bad error
           return fmt.Errorf("failed to read %s file [%s]", f.Name, crErr)
         }
+        line, _ := cr.FieldPos(0)
+
+        // if lenient, skip rows with a wrong number of fields
+        if opt.Lenient && len(r) != len(header) {
+          if sErr := skipRow(line, raw, fmt.Sprintf(
+            "wrong number of fields (%d, expected %d)", len(r), len(header)));
+            sErr != nil {
+            return sErr
+          }
+          continue
+        }
 
         // ensure proper number of fields
         row := make([]string, len(header))
@@ -420,32 +892,68 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
           row[i] = strings.TrimSpace(v)
         }
 
+        // derive "seconds" values for time columns
+        secs := ""
+        for _, tc := range timeCols {
+          if row[tc] == "" {
+            secs += ", null" // missing time, allowed
+            continue
+          }
+
+          s, tErr := parseGTFSTime(row[tc])
+          if tErr != nil {
+            secs += ", null"
+
+            // log invalid time (row is still imported)
+            if lErr := logImportError(db, f.Name, line, raw, fmt.Sprintf(
+              "invalid %s %q [%s]", header[tc], row[tc], tErr));
+              lErr != nil {
+              return fmt.Errorf("logImportError() %s", lErr)
+            }
+            continue
+          }
+
+          secs += fmt.Sprintf(", %d", s)
+        }
+
         // collect in sql-insert-ready format
-        values[i] = fmt.Sprintf(`(#!%s#!)`, strings.Join(row, `#!,#!`))
+        value := fmt.Sprintf(`(#!%s#!%s)`, strings.Join(row, `#!,#!`), secs)
 
         // ensure valid utf8
-        if utf8.ValidString(values[i]) == false {
-          return fmt.Errorf("encountered invalid utf8 in row [%s]", values[i])
+        if utf8.ValidString(value) == false {
+          if sErr := skipRow(line,
+            strings.ToValidUTF8(raw, "\uFFFD"), "invalid utf8");
+            sErr != nil {
+            return sErr
+          }
+          continue
         }
+
+        values = append(values, value)
+        lines = append(lines, line)
+        raws = append(raws, raw)
       }
 
       // extra case handler for empty rows
       if len(values) == 0 {
-        isEOF = true
-        continue // exit writing
+        continue // nothing to write
       }
 
       // ... and insert into table
-      cleanValuesStr := strings.Join(values, ", ")
-      cleanValuesStr = strings.Replace(cleanValuesStr, `'`, `''`, -1)
-      cleanValuesStr = strings.Replace(cleanValuesStr, `#!`, `'`, -1)
-      if _, itErr := db.Exec(fmt.Sprintf(
-        "insert into %s (%s) values %s;",
-        tablename,
-        strings.Join(header, ", "),
-        cleanValuesStr));
-        itErr != nil {
-        return fmt.Errorf("failed to insert %s [%s]", tablename, itErr)
+      if itErr := insertRows(values); itErr != nil {
+        if opt.Lenient == false {
+          return fmt.Errorf("failed to insert %s [%s]", tablename, itErr)
+        }
+
+        // if lenient, retry row by row to skip only the bad rows
+        for i := range values {
+          if irErr := insertRows(values[i:i+1]); irErr != nil {
+            if sErr := skipRow(lines[i], raws[i], irErr.Error());
+              sErr != nil {
+              return sErr
+            }
+          }
+        }
       }
     }
 
@@ -472,6 +980,12 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
                  create index route_dir_idx on trips (route_id,direction_id);`
     }
 
+    // add indexes to derived "seconds" columns
+    for _, sc := range secsCols {
+      iStmt += fmt.Sprintf("create index %s_%s_idx on %s (%s);",
+        tablename, sc, tablename, sc)
+    }
+
     if iStmt != "" {
       if _, ciErr := db.Exec(iStmt); ciErr != nil {
         return fmt.Errorf("failed add index(es) to %s [%s]", tablename, ciErr)
@@ -488,3 +1002,39 @@ func importGTFS(db *sql.DB, gtfs *zip.Reader) error {
 
   return nil
 }
+
+// logImportError Helper: Log a skipped GTFS row into "gtfs_import_errors".
+func logImportError(db *sql.DB, file string, line int, raw, reason string) error {
+  if _, err := db.Exec(
+    "insert into gtfs_import_errors (filename, line, raw, reason, logged_at) " +
+    "values (?, ?, ?, ?, datetime('now'));",
+    file, line, raw, reason); err != nil {
+    return fmt.Errorf("failed to log error for %s [%s]", file, err)
+  }
+
+  return nil
+}
+
+// rawReader Helper: io.Reader that retains the bytes it reads,
+// so the raw text of a csv row can be recovered by input offsets.
+type rawReader struct {
+  r     io.Reader
+  buf   []byte  // retained bytes, starting from offset "base"
+  base  int64
+}
+
+// Read implements io.Reader, retaining all bytes read.
+func (rr *rawReader) Read(p []byte) (int, error) {
+  n, err := rr.r.Read(p)
+  rr.buf = append(rr.buf, p[:n]...)
+  return n, err
+}
+
+// text returns raw text between input offsets [from, to),
+// and releases all retained bytes before "to".
+func (rr *rawReader) text(from, to int64) string {
+  raw := string(rr.buf[from-rr.base:to-rr.base])
+  rr.buf = rr.buf[to-rr.base:]
+  rr.base = to
+  return strings.TrimRight(raw, "\r\n")
+}
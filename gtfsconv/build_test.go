@@ -0,0 +1,50 @@
+package gtfsconv
+
+import (
+  "sync"
+  "testing"
+  "path/filepath"
+  "database/sql"
+)
+
+func TestOpenUntracked(t *testing.T) {
+  name := filepath.Join(t.TempDir(), "gtfs.sqlite")
+  db, oErr := sql.Open("sqlite3", name)
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  if _, cErr := db.Exec("create table stops (stop_id text);"); cErr != nil {
+    t.Fatalf("db.Exec() %s", cErr)
+  }
+  db.Close()
+
+  sqliteGTFSMu.Lock()
+  before := len(sqliteGTFSConns)
+  sqliteGTFSMu.Unlock()
+
+  // connections of Open (even concurrent) are never tracked
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      gdb, gErr := Open(name)
+      if gErr != nil {
+        t.Errorf("Open() %s", gErr)
+        return
+      }
+      defer gdb.Close()
+      if _, qErr := gdb.Exec("select secs_to_gtfs_time(3600);"); qErr != nil {
+        t.Errorf("secs_to_gtfs_time() %s", qErr)
+      }
+    }()
+  }
+  wg.Wait()
+
+  sqliteGTFSMu.Lock()
+  defer sqliteGTFSMu.Unlock()
+  if len(sqliteGTFSConns) != before {
+    t.Errorf("tracked connections = %d, want %d", len(sqliteGTFSConns),
+      before)
+  }
+}
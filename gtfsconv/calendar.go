@@ -0,0 +1,106 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "database/sql"
+)
+
+// sqlDate Helper: SQL expression converting a GTFS "YYYYMMDD"
+// date column into an sqlite date ("YYYY-MM-DD").
+func sqlDate(col string) string {
+  return fmt.Sprintf(
+    "date(substr(%[1]s,1,4)||'-'||substr(%[1]s,5,2)||'-'||substr(%[1]s,7,2))",
+    col)
+}
+
+// buildServiceDates creates "service_dates" table, with every date each
+// "service_id" runs (from "calendar", with "calendar_dates" exceptions),
+// and "service_summary" table, with active days for each "service_id".
+// note: only dates between startDate/endDate (if set) are expanded.
+func buildServiceDates(db *sql.DB, startDate, endDate string) error {
+
+  // default to unlimited date range
+  if startDate == "" {
+    startDate = "00000000"
+  }
+  if endDate == "" {
+    endDate = "99999999"
+  }
+
+  // (re)create "service_dates" table
+  if _, cErr := db.Exec(`
+    drop table if exists service_dates;
+    create table service_dates (service_id text, date text);
+    create unique index service_dates_idx on service_dates (service_id, date);
+    create index sd_date_idx on service_dates (date);`); cErr != nil {
+    return fmt.Errorf("failed to create table `service_dates` [%s]", cErr)
+  }
+
+  // expand each "calendar" service into its weekdays,
+  // from start_date to end_date (within date range)
+  if hasDBTable(db, "calendar") {
+    if _, iErr := db.Exec(fmt.Sprintf(`
+      with recursive
+        bounds (first, last) as (
+          select max(min(start_date), ?), min(max(end_date), ?) from calendar),
+        days (day) as (
+          select %s from bounds where first <= last
+          union all
+          select date(day, '+1 day') from days, bounds where day < %s)
+
+      insert into service_dates (service_id, date)
+      select distinct c.service_id, strftime('%%Y%%m%%d', d.day)
+      from calendar c join days d
+        on strftime('%%Y%%m%%d', d.day) between c.start_date and c.end_date
+      where cast(case strftime('%%w', d.day)
+        when '0' then c.sunday
+        when '1' then c.monday
+        when '2' then c.tuesday
+        when '3' then c.wednesday
+        when '4' then c.thursday
+        when '5' then c.friday
+        when '6' then c.saturday end as int) = 1;`,
+      sqlDate("first"), sqlDate("last")), startDate, endDate);
+      iErr != nil {
+      return fmt.Errorf("failed to expand calendar [%s]", iErr)
+    }
+  }
+
+  // apply "calendar_dates" exceptions (1 = added, 2 = removed)
+  if hasDBTable(db, "calendar_dates") {
+    if _, eErr := db.Exec(`
+      insert or ignore into service_dates (service_id, date)
+      select service_id, date from calendar_dates
+      where cast(exception_type as int) = 1 and date between ? and ?;
+
+      delete from service_dates where exists
+        (select 1 from calendar_dates cd
+        where cast(cd.exception_type as int) = 2
+          and cd.service_id = service_dates.service_id
+          and cd.date = service_dates.date);`,
+      startDate, endDate); eErr != nil {
+      return fmt.Errorf("failed to apply calendar_dates [%s]", eErr)
+    }
+  }
+
+  // (re)create "service_summary" table
+  if _, sErr := db.Exec(fmt.Sprintf(`
+    drop table if exists service_summary;
+    create table service_summary (service_id text, first_date text,
+      last_date text, active_days integer, weekdays integer,
+      saturdays integer, sundays integer);
+
+    insert into service_summary
+    select service_id, min(date), max(date), count(*),
+      sum(strftime('%%w', %[1]s) between '1' and '5'),
+      sum(strftime('%%w', %[1]s) = '6'),
+      sum(strftime('%%w', %[1]s) = '0')
+    from service_dates group by service_id;
+
+    create unique index service_summary_idx on service_summary (service_id);`,
+    sqlDate("date"))); sErr != nil {
+    return fmt.Errorf("failed to create table `service_summary` [%s]", sErr)
+  }
+
+  return nil
+}
@@ -0,0 +1,310 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "regexp"
+  "sort"
+  "strings"
+  "unicode"
+  "database/sql"
+)
+
+// stopCluster Type Helper: group of nearby, similarly named stops.
+type stopCluster struct {
+  id        string
+  name      string
+  lat, lon  float64 // centroid
+  stops     []footStop
+}
+
+// clusterNameWords: name abbreviations (normalized, for similarity)
+var clusterNameWords = map[string]string{
+  "st": "street", "av": "avenue", "ave": "avenue", "rd": "road",
+  "blvd": "boulevard", "dr": "drive", "ln": "lane", "pl": "place",
+  "sq": "square", "hwy": "highway", "pkwy": "parkway", "ctr": "center",
+  "sta": "station", "stn": "station", "term": "terminal",
+}
+
+// clusterSkipWords: generic name words (ignored, for similarity)
+var clusterSkipWords = map[string]bool{
+  "platform": true, "bay": true, "stand": true, "stop": true, "gate": true,
+  "track": true, "northbound": true, "southbound": true, "eastbound": true,
+  "westbound": true, "nb": true, "sb": true, "eb": true, "wb": true,
+  "and": true, "at": true, "of": true, "the": true,
+}
+
+// clusterNameSuffix: generic name suffix (removed, for cluster names)
+var clusterNameSuffix = regexp.MustCompile(
+  `(?i)[\s,(-]*\b(platform|bay|stand|stop|gate|track)\b\s*\w*\)?$`)
+
+// buildStopClusters groups nearby stops (location_type 0, or empty, and
+// without parent_station) within radius (in meters) of a seed stop, with
+// similar names (word similarity of at least similarity, from 0 to 1), into
+// "stop_clusters". If parents, synthesizes a parent station of each
+// cluster, into "stops_generated" (source "stops" is untouched, they're
+// only merged into exports, see stopsExportQuery).
+func buildStopClusters(db *sql.DB, radius, similarity float64,
+  parents bool) error {
+
+  // (re)create "stop_clusters" table
+  if _, cErr := db.Exec(`
+    drop table if exists stop_clusters;
+    create table stop_clusters (cluster_id text, cluster_name text,
+      cluster_lat real, cluster_lon real, num_stops integer, stop_id text,
+      distance real);`); cErr != nil {
+    return fmt.Errorf("failed to create table `stop_clusters` [%s]", cErr)
+  }
+
+  // (re)create "stops_generated" table (only, if parents)
+  if _, dErr := db.Exec("drop table if exists stops_generated;");
+    dErr != nil {
+    return fmt.Errorf("failed to drop table `stops_generated` [%s]", dErr)
+  }
+  if parents {
+    if _, cErr := db.Exec(`
+      create table stops_generated (stop_id text, stop_name text,
+        stop_lat text, stop_lon text, location_type text,
+        generated integer default 1);`); cErr != nil {
+      return fmt.Errorf("failed to create table `stops_generated` [%s]",
+        cErr)
+    }
+  }
+
+  all, sErr := queryFootStops(db)
+  if sErr != nil {
+    return fmt.Errorf("queryFootStops() %s", sErr)
+  }
+  var stops []footStop // only stops without parent station
+  for _, s := range all {
+    if s.station == "" {
+      stops = append(stops, s)
+    }
+  }
+
+  // nearby stops, with similar names (of each stop)
+  words := make([]map[string]bool, len(stops))
+  for i, s := range stops {
+    words[i] = nameWords(s.name)
+  }
+  near := make([][]int, len(stops))
+  eachNearbyPair(stops, radius, func(i, j int, dist float64) error {
+    if nameSimilarity(words[i], words[j]) >= similarity {
+      near[i] = append(near[i], j)
+    }
+    return nil
+  })
+
+  // seed clusters from stops with the most similar neighbors, with each
+  // (unclustered) similar neighbor within radius of the seed (so similar
+  // names never chain along a street, e.g., "Main St & 1st Av", "Main St
+  // & 2nd Av", ...)
+  seeds := make([]int, len(stops))
+  for i := range seeds {
+    seeds[i] = i
+  }
+  sort.SliceStable(seeds, func(a, b int) bool {
+    return len(near[seeds[a]]) > len(near[seeds[b]])
+  })
+  clustered := make([]bool, len(stops))
+  var clusters []*stopCluster
+  for _, i := range seeds {
+    if clustered[i] {
+      continue
+    }
+    clustered[i] = true
+    c := &stopCluster{stops: []footStop{stops[i]}}
+    for _, j := range near[i] {
+      if clustered[j] == false {
+        clustered[j] = true
+        c.stops = append(c.stops, stops[j])
+      }
+    }
+    sort.Slice(c.stops, func(a, b int) bool {
+      return c.stops[a].id < c.stops[b].id
+    })
+    clusters = append(clusters, c)
+  }
+  sort.Slice(clusters, func(a, b int) bool { // in order of first stop
+    return clusters[a].stops[0].id < clusters[b].stops[0].id
+  })
+
+  // collect existing stop ids (to avoid collisions)
+  existing := map[string]bool{}
+  ids, iErr := db.Query("select stop_id from stops;")
+  if iErr != nil {
+    return fmt.Errorf("failed to select stops [%s]", iErr)
+  }
+  for ids.Next() {
+    var id string
+    if sErr := ids.Scan(&id); sErr != nil {
+      ids.Close()
+      return fmt.Errorf("failed to scan stops [%s]", sErr)
+    }
+    existing[id] = true
+  }
+  ids.Close()
+
+  // name, and locate, each cluster
+  n := 0
+  var multi []*stopCluster
+  for _, c := range clusters {
+    if len(c.stops) < 2 {
+      continue
+    }
+    for n++; existing[fmt.Sprintf("cluster_%d", n)]; n++ {}
+    c.id = fmt.Sprintf("cluster_%d", n)
+    c.name = clusterName(c.stops)
+    for _, s := range c.stops {
+      c.lat += s.lat / float64(len(c.stops))
+      c.lon += s.lon / float64(len(c.stops))
+    }
+    c.lat, c.lon = math.Round(c.lat * 1e6) / 1e6, math.Round(c.lon * 1e6) / 1e6
+    multi = append(multi, c)
+  }
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for _, c := range multi {
+    for _, s := range c.stops {
+      if _, iErr := tx.Exec("insert into stop_clusters values " +
+        "(?, ?, ?, ?, ?, ?, ?);", c.id, c.name, c.lat, c.lon, len(c.stops),
+        s.id, math.Round(haversine(c.lat, c.lon, s.lat, s.lon) * 10) / 10);
+        iErr != nil {
+        return fmt.Errorf("failed to insert into `stop_clusters` [%s]", iErr)
+      }
+    }
+
+    if parents == false {
+      continue
+    }
+
+    // synthesized parent station
+    if _, iErr := tx.Exec("insert into stops_generated values " +
+      "(?, ?, ?, ?, '1', 1);", c.id, c.name, fmt.Sprint(c.lat),
+      fmt.Sprint(c.lon)); iErr != nil {
+      return fmt.Errorf("failed to insert into `stops_generated` [%s]", iErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create index stop_clusters_idx on stop_clusters (cluster_id);
+    create index stop_clusters_stop_idx on stop_clusters (stop_id);`);
+    ciErr != nil {
+    return fmt.Errorf("failed add index(es) to stop_clusters [%s]", ciErr)
+  }
+
+  return nil
+}
+
+// stopsExportQuery Helper: Query of all "stops" for exports, merged with
+// synthesized parent stations (if "stops_generated" exists, see
+// buildStopClusters), as parent_station of their (clustered) stops.
+func stopsExportQuery(db *sql.DB) (string, error) {
+  if hasDBTable(db, "stops_generated") == false {
+    return "select * from stops", nil
+  }
+
+  stopCols, cErr := getDBTableCols(db, "stops")
+  if cErr != nil {
+    return "", fmt.Errorf("getDBTableCols() %s", cErr)
+  }
+  var cols []string
+  for _, c := range stopCols {
+    if c != "generated" {
+      cols = append(cols, c)
+    }
+  }
+  for _, c := range [...]string{"location_type", "parent_station"} {
+    if isStrIn(c, cols) == false {
+      cols = append(cols, c)
+    }
+  }
+
+  // each column, of stops, and of generated stops (empty, if missing)
+  stops := make([]string, len(cols))
+  generated := make([]string, len(cols))
+  for i, c := range cols {
+    stops[i] = "''"
+    if hasDBTableCol(db, "stops", c) {
+      stops[i] = "coalesce(s." + c + ", '')"
+    }
+    generated[i] = "''"
+
+    switch c {
+      case "stop_id", "stop_name", "stop_lat", "stop_lon", "location_type":
+        generated[i] = "g." + c
+      case "parent_station":
+        stops[i] = fmt.Sprintf("coalesce(nullif(%s, ''), (select " +
+          "cluster_id from stop_clusters c where c.stop_id = s.stop_id " +
+          "limit 1), '')", stops[i])
+    }
+    stops[i] += " as " + c
+  }
+
+  return fmt.Sprintf("select %s, 0 as generated from stops s union all " +
+    "select %s, g.generated from stops_generated g",
+    strings.Join(stops, ", "), strings.Join(generated, ", ")), nil
+}
+
+// nameWords Helper: Normalized words of a stop name (lowercase, expanded
+// abbreviations, without generic words, or single letters/digits).
+func nameWords(name string) map[string]bool {
+  words := map[string]bool{}
+  for _, w := range strings.FieldsFunc(strings.ToLower(name),
+    func(r rune) bool {
+      return unicode.IsLetter(r) == false && unicode.IsDigit(r) == false
+    }) {
+    if full, ok := clusterNameWords[w]; ok {
+      w = full
+    }
+    if clusterSkipWords[w] || len([]rune(w)) < 2 {
+      continue
+    }
+    words[w] = true
+  }
+  return words
+}
+
+// nameSimilarity Helper: Word similarity (jaccard index, from 0 to 1).
+func nameSimilarity(a, b map[string]bool) float64 {
+  common := 0
+  for w := range a {
+    if b[w] {
+      common++
+    }
+  }
+  if union := len(a) + len(b) - common; union > 0 {
+    return float64(common) / float64(union)
+  }
+  return 0
+}
+
+// clusterName Helper: Name of cluster, as its most similar stop name (to
+// all others, or shortest, if tied), without generic suffix (e.g.,
+// "Platform A").
+func clusterName(stops []footStop) string {
+  best, bestScore := "", -1.0
+  for _, a := range stops {
+    score := 0.0
+    for _, b := range stops {
+      score += nameSimilarity(nameWords(a.name), nameWords(b.name))
+    }
+    if score > bestScore || (score == bestScore && len(a.name) < len(best)) {
+      best, bestScore = a.name, score
+    }
+  }
+
+  if name := clusterNameSuffix.ReplaceAllString(best, ""); name != "" {
+    return strings.TrimSpace(name)
+  }
+  return best
+}
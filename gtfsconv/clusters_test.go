@@ -0,0 +1,69 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "database/sql"
+)
+
+func TestStopClusterParents(t *testing.T) {
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1) // each connection is its own db
+  defer db.Close()
+
+  if _, eErr := db.Exec(`
+    create table stops (stop_id text, stop_name text, stop_lat text,
+      stop_lon text, parent_station text);
+    insert into stops values
+      ('A1', 'Oak St Stop A', '40.7150', '-74.0010', ''),
+      ('A2', 'Oak St Stop B', '40.7151', '-74.0011', ''),
+      ('B', 'Harbor Terminal', '40.7200', '-74.0050', '');`); eErr != nil {
+    t.Fatalf("db.Exec() %s", eErr)
+  }
+
+  if cErr := buildStopClusters(db, 50, 0.5, true); cErr != nil {
+    t.Fatalf("buildStopClusters() %s", cErr)
+  }
+
+  query := func(q string) []string {
+    rows, qErr := db.Query(q)
+    if qErr != nil {
+      t.Fatalf("db.Query() %s", qErr)
+    }
+    defer rows.Close()
+
+    var got []string
+    for rows.Next() {
+      var id, parent, generated string
+      if sErr := rows.Scan(&id, &parent, &generated); sErr != nil {
+        t.Fatalf("rows.Scan() %s", sErr)
+      }
+      got = append(got, fmt.Sprintf("%s %q %s", id, parent, generated))
+    }
+    return got
+  }
+
+  // source stops are untouched
+  stops := query("select stop_id, parent_station, '' from stops " +
+    "order by stop_id;")
+  if want := []string{`A1 "" `, `A2 "" `, `B "" `};
+    reflect.DeepEqual(stops, want) == false {
+    t.Errorf("stops = %q, want %q", stops, want)
+  }
+
+  // merged only into exports
+  export, eErr := stopsExportQuery(db)
+  if eErr != nil {
+    t.Fatalf("stopsExportQuery() %s", eErr)
+  }
+  merged := query("select stop_id, parent_station, generated from (" +
+    export + ") order by stop_id;")
+  if want := []string{`A1 "cluster_1" 0`, `A2 "cluster_1" 0`, `B "" 0`,
+    `cluster_1 "" 1`}; reflect.DeepEqual(merged, want) == false {
+    t.Errorf("exported stops = %q, want %q", merged, want)
+  }
+}
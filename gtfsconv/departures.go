@@ -0,0 +1,203 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "sort"
+  "time"
+  "database/sql"
+)
+
+// Departure is a scheduled departure from a stop (see NextDepartures).
+type Departure struct {
+  StopID      string
+  RouteID     string
+  RouteName   string    // short name, or long name
+  TripID      string    // (or "trip@HH:MM:SS", of frequency-based runs)
+  Headsign    string    // stop_headsign, or trip_headsign
+  ServiceDate string    // YYYYMMDD
+  Time        time.Time // in agency_timezone
+}
+
+// AgencyLocation returns the time zone of the (first) agency, or
+// time.Local, if missing.
+func AgencyLocation(db *sql.DB) (*time.Location, error) {
+  if hasDBTableCol(db, "agency", "agency_timezone") == false {
+    return time.Local, nil
+  }
+
+  var tz string
+  if qErr := db.QueryRow("select coalesce(agency_timezone, '') " +
+    "from agency limit 1;").Scan(&tz); qErr != nil && qErr != sql.ErrNoRows {
+    return nil, fmt.Errorf("failed to select agency_timezone [%s]", qErr)
+  }
+  if tz == "" {
+    return time.Local, nil
+  }
+
+  loc, lErr := time.LoadLocation(tz)
+  if lErr != nil {
+    return nil, fmt.Errorf("invalid agency_timezone %q [%s]", tz, lErr)
+  }
+  return loc, nil
+}
+
+// ServiceTime returns the time of a GTFS time (secs, seconds since "noon
+// minus 12h", e.g., 25:10:00 is past midnight) on a service date
+// ("YYYYMMDD"), in loc (e.g., see AgencyLocation).
+func ServiceTime(date string, secs int, loc *time.Location) (time.Time,
+  error) {
+  ref, rErr := serviceDayRef(date, loc)
+  if rErr != nil {
+    return time.Time{}, fmt.Errorf("invalid date %q, expected YYYYMMDD", date)
+  }
+  return ref.Add(time.Duration(secs) * time.Second), nil
+}
+
+// NextDepartures returns the next n departures (at, or after, t) from a
+// stop (or child stops, of a parent station), by time. Trips are those
+// active on the service date of t (in agency_timezone), the previous date
+// (running past midnight, e.g., "25:10:00"), and the next date, with each
+// run of frequency-based trips. Last stops of trips (arrivals only), and
+// stops with pickup_type 1, are skipped.
+func NextDepartures(db *sql.DB, stopID string, t time.Time,
+  n int) ([]Departure, error) {
+
+  // sanity checks (service dates, derived "seconds" columns)
+  if hasDBTable(db, "service_dates") == false {
+    return nil, fmt.Errorf("missing service_dates table")
+  }
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return nil, rErr
+  }
+
+  loc, lErr := AgencyLocation(db)
+  if lErr != nil {
+    return nil, fmt.Errorf("AgencyLocation() %s", lErr)
+  }
+
+  // service date refs ("noon minus 12h"), of previous, same, next date
+  day := t.In(loc)
+  refs := map[string]time.Time{}
+  var dates []interface{}
+  for _, offset := range [...]int{-1, 0, 1} {
+    d := time.Date(day.Year(), day.Month(), day.Day() + offset, 12, 0, 0, 0,
+      loc).Format("20060102")
+    ref, rErr := serviceDayRef(d, loc)
+    if rErr != nil {
+      return nil, fmt.Errorf("serviceDayRef() %s", rErr)
+    }
+    refs[d] = ref
+    dates = append(dates, d)
+  }
+
+  // the stop, and its child stops
+  stops := "select ?4"
+  if hasDBTableCol(db, "stops", "parent_station") {
+    stops += " union select stop_id from stops where parent_station = ?4"
+  }
+  var found int
+  if qErr := db.QueryRow("select count(*) from stops where stop_id = ?;",
+    stopID).Scan(&found); qErr != nil {
+    return nil, fmt.Errorf("failed to select stops [%s]", qErr)
+  }
+  if found == 0 {
+    return nil, fmt.Errorf("unknown stop %q", stopID)
+  }
+
+  freqs, fErr := queryFrequencyRuns(db)
+  if fErr != nil {
+    return nil, fmt.Errorf("queryFrequencyRuns() %s", fErr)
+  }
+
+  // departures (of each active service date), with trip's first departure
+  routeName, routeJoin := "''", ""
+  if hasDBTable(db, "routes") {
+    routeName = fmt.Sprintf("coalesce(nullif(%s, ''), %s)",
+      optDBTableCol(db, "r", "routes", "route_short_name"),
+      optDBTableCol(db, "r", "routes", "route_long_name"))
+    routeJoin = "left join routes r on r.route_id = t.route_id"
+  }
+  rows, qErr := db.Query(fmt.Sprintf(`
+    with trip_ends as (
+      select trip_id, max(cast(stop_sequence as int)) as last_seq,
+        min(coalesce(departure_secs, arrival_secs)) as first_dep
+      from stop_times
+      where trip_id in (select trip_id from stop_times
+        where stop_id in (%s))
+      group by trip_id)
+    select st.stop_id, t.route_id, %s, t.trip_id,
+      coalesce(nullif(%s, ''), %s), sd.date,
+      coalesce(st.departure_secs, st.arrival_secs), te.first_dep
+    from stop_times st
+      join trips t on t.trip_id = st.trip_id
+      join service_dates sd on sd.service_id = t.service_id
+      join trip_ends te on te.trip_id = st.trip_id
+      %s
+    where st.stop_id in (%s)
+      and sd.date in (?1, ?2, ?3)
+      and coalesce(st.departure_secs, st.arrival_secs) is not null
+      and cast(st.stop_sequence as int) < te.last_seq
+      and %s != '1';`,
+    stops, routeName, optDBTableCol(db, "st", "stop_times", "stop_headsign"),
+    optDBTableCol(db, "t", "trips", "trip_headsign"), routeJoin, stops,
+    optDBTableCol(db, "st", "stop_times", "pickup_type")),
+    dates[0], dates[1], dates[2], stopID)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select departures [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var departures []Departure
+  for rows.Next() {
+    var d Departure
+    var dep, firstDep int
+    if sErr := rows.Scan(&d.StopID, &d.RouteID, &d.RouteName, &d.TripID,
+      &d.Headsign, &d.ServiceDate, &dep, &firstDep); sErr != nil {
+      return nil, fmt.Errorf("failed to scan departures [%s]", sErr)
+    }
+    ref := refs[d.ServiceDate]
+
+    // each run (each departure of frequency-based trips)
+    fs, ok := freqs[d.TripID]
+    if ok == false {
+      if d.Time = ref.Add(time.Duration(dep) * time.Second);
+        d.Time.Before(t) == false {
+        departures = append(departures, d)
+      }
+      continue
+    }
+    tripID := d.TripID
+    for _, f := range fs {
+      for secs := f[0]; secs < f[1]; secs += f[2] {
+        run := d
+        run.TripID = tripID + "@" + FormatClock(secs)
+        run.Time = ref.Add(time.Duration(dep - firstDep + secs) * time.Second)
+        if run.Time.Before(t) == false {
+          departures = append(departures, run)
+        }
+      }
+    }
+  }
+  if rErr := rows.Err(); rErr != nil {
+    return nil, fmt.Errorf("failed to select departures [%s]", rErr)
+  }
+
+  sort.Slice(departures, func(i, j int) bool {
+    a, b := departures[i], departures[j]
+    if a.Time.Equal(b.Time) == false {
+      return a.Time.Before(b.Time)
+    }
+    if a.RouteName != b.RouteName {
+      return a.RouteName < b.RouteName
+    }
+    return a.TripID < b.TripID
+  })
+
+  if n > 0 && len(departures) > n {
+    departures = departures[:n]
+  }
+  for i := range departures {
+    departures[i].Time = departures[i].Time.In(loc)
+  }
+  return departures, nil
+}
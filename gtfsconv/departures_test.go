@@ -0,0 +1,41 @@
+package gtfsconv
+
+import (
+  "testing"
+  "time"
+)
+
+func TestServiceTime(t *testing.T) {
+  loc, lErr := time.LoadLocation("America/New_York")
+  if lErr != nil {
+    t.Skipf("time.LoadLocation() %s", lErr)
+  }
+
+  tests := []struct {
+    date  string
+    secs  int
+    want  string // in loc
+  }{
+    {"20260105", 8*3600, "2026-01-05 08:00:00 EST"},
+    {"20260105", 25*3600 + 600, "2026-01-06 01:10:00 EST"},
+
+    // DST transitions (service day starts at "noon minus 12h")
+    {"20260308", 8*3600, "2026-03-08 08:00:00 EDT"},
+    {"20261101", 8*3600, "2026-11-01 08:00:00 EST"},
+  }
+
+  for _, tc := range tests {
+    got, sErr := ServiceTime(tc.date, tc.secs, loc)
+    if sErr != nil {
+      t.Fatalf("ServiceTime() %s", sErr)
+    }
+    if s := got.In(loc).Format("2006-01-02 15:04:05 MST"); s != tc.want {
+      t.Errorf("ServiceTime(%s, %d) = %s, want %s", tc.date, tc.secs, s,
+        tc.want)
+    }
+  }
+
+  if _, sErr := ServiceTime("2026-01-05", 0, loc); sErr == nil {
+    t.Errorf("ServiceTime() invalid date, expected error")
+  }
+}
@@ -0,0 +1,148 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "time"
+  "database/sql"
+
+  _ "time/tzdata" // embed Go's time zone database, if missing on host
+)
+
+// buildScheduledEvents creates "scheduled_events" table, with absolute
+// arrival/departure times (as UTC unix epoch) of every stop of every trip,
+// on every service date (see "service_dates").
+// note: GTFS times are relative to "noon minus 12h" of the service date,
+//       in the agency_timezone (not stop_timezone), which handles days
+//       with DST transitions.
+func buildScheduledEvents(db *sql.DB) error {
+
+  // sanity check for required tables/columns
+  if hasDBTable(db, "service_dates") == false {
+    return fmt.Errorf("missing service_dates table")
+  }
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return rErr
+  }
+
+  // determine timezone of each route (from its agency)
+  routeAgency := "(select agency_timezone from agency limit 1)"
+  if hasDBTableCol(db, "routes", "agency_id") &&
+     hasDBTableCol(db, "agency", "agency_id") {
+    routeAgency = "coalesce((select agency_timezone from agency a " +
+      "where a.agency_id = r.agency_id), " + routeAgency + ")"
+  }
+  if _, rtErr := db.Exec(fmt.Sprintf(`
+    drop table if exists temp.route_tz;
+    create temp table route_tz as
+    select r.route_id, %s as timezone from routes r;
+    create index temp.route_tz_idx on route_tz (route_id);`,
+    routeAgency)); rtErr != nil {
+    return fmt.Errorf("failed to determine route timezones [%s]", rtErr)
+  }
+
+  // collect each service date, for each timezone
+  var days [][2]string
+  rows, qErr := db.Query(`
+    select distinct rt.timezone, sd.date from service_dates sd,
+      (select distinct timezone from temp.route_tz) rt;`)
+  if qErr != nil {
+    return fmt.Errorf("failed to query service dates [%s]", qErr)
+  }
+  for rows.Next() {
+    var tz, date string
+    if sErr := rows.Scan(&tz, &date); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan service dates [%s]", sErr)
+    }
+    days = append(days, [2]string{tz, date})
+  }
+  rows.Close()
+
+  // compute the reference time ("noon minus 12h")
+  // of each service date, for each timezone
+  if _, cErr := db.Exec(`
+    drop table if exists temp.service_day_refs;
+    create temp table service_day_refs
+      (timezone text, date text, ref_utc integer);`); cErr != nil {
+    return fmt.Errorf("failed to create service_day_refs [%s]", cErr)
+  }
+
+  locs := map[string]*time.Location{}
+  for _, d := range days {
+    loc, ok := locs[d[0]]
+    if ok == false {
+      l, lErr := time.LoadLocation(d[0])
+      if lErr != nil {
+        return fmt.Errorf("invalid agency_timezone %q [%s]", d[0], lErr)
+      }
+      loc, locs[d[0]] = l, l
+    }
+
+    ref, rErr := serviceDayRef(d[1], loc)
+    if rErr != nil {
+      return fmt.Errorf("invalid service date %q [%s]", d[1], rErr)
+    }
+
+    if _, iErr := db.Exec(
+      "insert into temp.service_day_refs values (?, ?, ?);",
+      d[0], d[1], ref.Unix()); iErr != nil {
+      return fmt.Errorf("failed to insert service_day_refs [%s]", iErr)
+    }
+  }
+
+  if _, ciErr := db.Exec("create index temp.sdr_idx " +
+    "on service_day_refs (timezone, date);"); ciErr != nil {
+    return fmt.Errorf("failed add index(es) to service_day_refs [%s]", ciErr)
+  }
+
+  // use expanded stop times, for frequency-based trips (if exists)
+  source, tripCol := "stop_times", "trip_id"
+  if hasDBTable(db, "stop_times_expanded") {
+    source, tripCol = "stop_times_expanded", "template_trip_id"
+  }
+
+  // (re)create "scheduled_events" table
+  if _, cErr := db.Exec(fmt.Sprintf(`
+    drop table if exists scheduled_events;
+    create table scheduled_events (trip_id text, stop_id text,
+      stop_sequence integer, service_date text,
+      arrival_utc integer, departure_utc integer);
+
+    insert into scheduled_events
+    select st.trip_id, st.stop_id, cast(st.stop_sequence as int), sd.date,
+      ref.ref_utc + st.arrival_secs, ref.ref_utc + st.departure_secs
+    from service_dates sd
+      join trips t on t.service_id = sd.service_id
+      join temp.route_tz rt on rt.route_id = t.route_id
+      join temp.service_day_refs ref
+        on ref.timezone = rt.timezone and ref.date = sd.date
+      join %s st on st.%s = t.trip_id;
+
+    drop table temp.service_day_refs;
+    drop table temp.route_tz;`, source, tripCol)); cErr != nil {
+    return fmt.Errorf("failed to create table `scheduled_events` [%s]", cErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create index se_trip_idx on scheduled_events (trip_id, service_date);
+    create index se_stop_idx on scheduled_events (stop_id, departure_utc);
+    create index se_departure_idx on scheduled_events (departure_utc);`);
+    ciErr != nil {
+    return fmt.Errorf("failed add index(es) to scheduled_events [%s]", ciErr)
+  }
+
+  return nil
+}
+
+// serviceDayRef Helper: Reference time of a GTFS "YYYYMMDD" service date
+// in loc, which is "noon minus 12h" (i.e., midnight, except on days with
+// DST transitions). GTFS times are seconds since this reference.
+func serviceDayRef(date string, loc *time.Location) (time.Time, error) {
+  d, pErr := time.ParseInLocation("20060102", date, loc)
+  if pErr != nil {
+    return time.Time{}, pErr
+  }
+
+  noon := time.Date(d.Year(), d.Month(), d.Day(), 12, 0, 0, 0, loc)
+  return noon.Add(-12 * time.Hour), nil
+}
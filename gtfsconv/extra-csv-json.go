@@ -78,8 +78,15 @@ func exportJSON(dir string, db *sql.DB) error {
       continue // ignore missing tables
     }
 
-    // retrieve all rows
-    rows, queryErr := db.Query(fmt.Sprintf("select * from %s;", tbl))
+    // retrieve all rows (of stops, with synthesized parent stations)
+    query := fmt.Sprintf("select * from %s", tbl)
+    if tbl == "stops" {
+      var qErr error
+      if query, qErr = stopsExportQuery(db); qErr != nil {
+        return fmt.Errorf("stopsExportQuery() %s", qErr)
+      }
+    }
+    rows, queryErr := db.Query(query + ";")
     if queryErr != nil {
       return fmt.Errorf("failed to select all from %s [%s]", tbl, queryErr)
     }
@@ -126,5 +133,97 @@ func exportJSON(dir string, db *sql.DB) error {
     }
   }
 
+  if hasDBTable(db, "patterns") { // only export, if patterns were built
+    if pErr := exportJSONPatterns(dir, db); pErr != nil {
+      return fmt.Errorf("exportJSONPatterns() %s", pErr)
+    }
+  }
+
+  if hasDBTable(db, "headways") { // only export, if headways were built
+    if hErr := exportJSONHeadways(dir, db); hErr != nil {
+      return fmt.Errorf("exportJSONHeadways() %s", hErr)
+    }
+  }
+
+  return nil
+}
+
+// exportJSONPatterns Helper: Export JSON for "patterns" table
+// (with ordered stops, and trips, of each pattern).
+func exportJSONPatterns(dir string, db *sql.DB) error {
+  patterns, pErr := queryPatterns(db)
+  if pErr != nil {
+    return fmt.Errorf("queryPatterns() %s", pErr)
+  }
+
+  var jsonCol []jsony
+  for _, p := range patterns {
+    jsonCol = append(jsonCol, jsony{
+      "pattern_id":   p.id,
+      "route_id":     p.routeID,
+      "direction_id": p.directionID,
+      "shape_id":     p.shapeID,
+      "name":         p.name,
+      "num_trips":    p.numTrips,
+      "is_primary":   p.isPrimary,
+      "stops":        p.stops,
+      "trips":        p.trips,
+    })
+  }
+
+  if wErr := writeJSON(dir + "patterns.json", jsonCol); wErr != nil {
+    return fmt.Errorf("writeJSON() for all patterns [%s]", wErr)
+  }
+
+  return nil
+}
+
+// exportJSONHeadways Helper: Export JSON for "headways" table.
+func exportJSONHeadways(dir string, db *sql.DB) error {
+  rows, qErr := db.Query(`
+    select date, route_id, direction_id, stop_id, period, num_trips,
+      min_headway_secs, avg_headway_secs, max_headway_secs,
+      first_departure, last_departure
+    from headways order by route_id, direction_id, stop_id;`)
+  if qErr != nil {
+    return fmt.Errorf("failed to select headways [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var jsonCol []jsony
+  for rows.Next() {
+    var date, route, dir, stop, period, first, last string
+    var numTrips int
+    var minH, avgH, maxH sql.NullFloat64 // null, if less than 2 trips
+    if sErr := rows.Scan(&date, &route, &dir, &stop, &period, &numTrips,
+      &minH, &avgH, &maxH, &first, &last); sErr != nil {
+      return fmt.Errorf("failed to scan headways [%s]", sErr)
+    }
+
+    row := jsony{
+      "date":             date,
+      "route_id":         route,
+      "direction_id":     dir,
+      "stop_id":          stop,
+      "period":           period,
+      "num_trips":        numTrips,
+      "min_headway_secs": nil,
+      "avg_headway_secs": nil,
+      "max_headway_secs": nil,
+      "first_departure":  first,
+      "last_departure":   last,
+    }
+    if avgH.Valid {
+      row["min_headway_secs"] = minH.Float64
+      row["avg_headway_secs"] = avgH.Float64
+      row["max_headway_secs"] = maxH.Float64
+    }
+    jsonCol = append(jsonCol, row)
+  }
+
+  if wErr := writeJSON(dir + "headways.json", jsonCol); wErr != nil {
+    return fmt.Errorf("writeJSON() for all headways [%s]", wErr)
+  }
+
   return nil
 }
@@ -3,58 +3,86 @@ package gtfsconv
 import (
   "os"
   "fmt"
+  "strings"
   "database/sql"
   "io/ioutil"
 )
 
-// exportGeoJSON creates geojson files from sqlite db.
-func exportGeoJSON(dir string, db *sql.DB) error {
+// exportGeoJSON creates geojson files from sqlite db,
+// with coordinates (and shapes) simplified with simp.
+func exportGeoJSON(dir string, db *sql.DB, simp shapeSimplifier) error {
   dir += "geojson/" // export to "geojson" subdir
   stopsDir := dir+"stops/"
   shapesDir := dir+"shapes/"
   routesDir := dir+"routes/"
   transfersDir := dir+"transfers/"
+  patternsDir := dir+"patterns/"
+  segmentsDir := dir+"segments/"
 
   // ensure dir (and extra subdirs) exists
-  for _, d := range [...]string{
-    dir, shapesDir, stopsDir, transfersDir, routesDir} {
+  for _, d := range [...]string{dir, shapesDir, stopsDir, transfersDir,
+    routesDir, patternsDir, segmentsDir} {
     if mkdirErr := os.MkdirAll(d, 0777); mkdirErr != nil {
       return mkdirErr
     }
   }
 
-  if stopsErr := exportGeoJSONStops(stopsDir, db); stopsErr != nil {
+  if stopsErr := exportGeoJSONStops(stopsDir, db, simp); stopsErr != nil {
     return fmt.Errorf("exportGeoJSONStops() %s", stopsErr)
   }
 
   if hasDBTable(db, "shapes") { // only export, if "shapes" table exists
-    if shapesErr := exportGeoJSONShapes(shapesDir, db); shapesErr != nil {
+    if shapesErr := exportGeoJSONShapes(shapesDir, db, simp);
+      shapesErr != nil {
       return fmt.Errorf("exportGeoJSONShapes() %s", shapesErr)
     }
 
     // only export if spatialite is enabled, and "routes_geo" table exists
     if hasDBSpatialite(db) && hasDBTable(db, "routes_geo") {
-      if routesErr := exportGeoJSONRoutes(routesDir, db); routesErr != nil {
+      if routesErr := exportGeoJSONRoutes(routesDir, db, simp);
+        routesErr != nil {
         return fmt.Errorf("exportGeoJSONRoutes() %s", routesErr)
       }
     }
   }
 
-  if hasDBTable(db, "transfers") { // only export, if table exists
-    if transErr := exportGeoJSONTransfers(transfersDir, db); transErr != nil {
+  // only export, if any transfers table exists
+  if hasDBTable(db, "transfers") || hasDBTable(db, "transfers_generated") {
+    if transErr := exportGeoJSONTransfers(transfersDir, db, simp);
+      transErr != nil {
       return fmt.Errorf("exportGeoJSONTransfers() %s", transErr)
     }
   }
 
+  if hasDBTable(db, "patterns") { // only export, if patterns were built
+    if patErr := exportGeoJSONPatterns(patternsDir, db, simp);
+      patErr != nil {
+      return fmt.Errorf("exportGeoJSONPatterns() %s", patErr)
+    }
+  }
+
+  if hasDBTable(db, "segments") { // only export, if segments were built
+    if segErr := exportGeoJSONSegments(segmentsDir, db, simp);
+      segErr != nil {
+      return fmt.Errorf("exportGeoJSONSegments() %s", segErr)
+    }
+  }
+
   return nil
 }
 
-// exportGeoJSONStops Helper: Export GeoJSON for "stops" table.
-func exportGeoJSONStops(dir string, db *sql.DB) error {
+// exportGeoJSONStops Helper: Export GeoJSON for "stops" table (with
+// synthesized parent stations, see stopsExportQuery), with coordinates
+// quantized with simp.
+func exportGeoJSONStops(dir string, db *sql.DB, simp shapeSimplifier) error {
 
   // retrieve all stops
-  stops, stopsErr := db.Query(
-    "select stop_id, stop_name, stop_lat, stop_lon from stops;")
+  query, qErr := stopsExportQuery(db)
+  if qErr != nil {
+    return fmt.Errorf("stopsExportQuery() %s", qErr)
+  }
+  stops, stopsErr := db.Query("select stop_id, stop_name, stop_lat, " +
+    "stop_lon from (" + query + ");")
   if stopsErr != nil {
     return fmt.Errorf("failed to select stops [%s]", stopsErr)
   }
@@ -78,7 +106,7 @@ func exportGeoJSONStops(dir string, db *sql.DB) error {
       },
       "geometry": jsony{
         "type": "Point",
-        "coordinates": [2]float64{lng, lat},
+        "coordinates": [2]float64{simp.round(lng), simp.round(lat)},
       },
     }
 
@@ -103,61 +131,33 @@ func exportGeoJSONStops(dir string, db *sql.DB) error {
   return nil
 }
 
-// exportGeoJSONShapes Helper: Export GeoJSON for "shapes" table.
-func exportGeoJSONShapes(dir string, db *sql.DB) error {
+// exportGeoJSONShapes Helper: Export GeoJSON for "shapes" table,
+// with shapes simplified (and quantized) with simp.
+func exportGeoJSONShapes(dir string, db *sql.DB, simp shapeSimplifier) error {
 
-  // retrieve all unique shapes
-  var shapeIDs []string
-  shapes, shapesErr := db.Query(
-    "select distinct(shape_id) as id from shapes;")
-  if shapesErr != nil {
-    return fmt.Errorf("failed to select `distinct(shape_id)` [%s]", shapesErr)
+  // retrieve all shapes (with points)
+  shapes, sErr := queryShapes(db)
+  if sErr != nil {
+    return fmt.Errorf("queryShapes() %s", sErr)
   }
 
-  var id string // placeholder for "shape_id" col
   var features []jsony
-  for shapes.Next() {
-    if scanErr := shapes.Scan(&id); scanErr != nil {
-      return fmt.Errorf("failed to scan shapes query [%s]", scanErr)
-    }
-
-    shapeIDs = append(shapeIDs, id)
-  }
-  shapes.Close()
-
-  for _, id := range shapeIDs {
-
-    // retrive all points for this shape
-    var shapeLine [][2]float64
-    var lat, lng float64 // placeholder for "lat", "lon" col
-    points, ptErr := db.Query(
-      "select shape_pt_lat, shape_pt_lon from shapes " +
-      "where shape_id = ? order by cast(shape_pt_sequence as int) asc;", id)
-    if ptErr != nil {
-      return fmt.Errorf("failed to select shape points [%s]", ptErr)
-    }
-    defer points.Close()
-    for points.Next() {
-      if ptscanErr := points.Scan(&lat, &lng); ptscanErr != nil {
-        return fmt.Errorf("failed to scan shapes points query [%s]", ptscanErr)
-      }
-      shapeLine = append(shapeLine, [2]float64{lng, lat})
-    }
+  for _, s := range shapes {
 
     // create final geojson "Feature"
     feature := jsony{
       "type": "Feature",
       "properties": jsony{
-        "shape_id": id,
+        "shape_id": s.id,
       },
       "geometry": jsony{
         "type": "LineString",
-        "coordinates": shapeLine,
+        "coordinates": simp.apply(s.points),
       },
     }
 
     // write geojson "Feature"
-    if wjErr := writeJSON(dir+"shape."+id+".geojson", feature);
+    if wjErr := writeJSON(dir+"shape."+s.id+".geojson", feature);
       wjErr != nil {
       return fmt.Errorf("writeJSON() %s", wjErr)
     }
@@ -179,22 +179,30 @@ func exportGeoJSONShapes(dir string, db *sql.DB) error {
 
 // exportGeoJSONRoutes Helper: Export GeoJSON for special
 // intersections of "stops" against "routes"+"trips"+"shapes" data.
+// with coordinates quantized with simp (shapes_geo is already simplified).
 // note: Spatialite extension must be enabled!
-func exportGeoJSONRoutes(dir string, db *sql.DB) error {
+func exportGeoJSONRoutes(dir string, db *sql.DB, simp shapeSimplifier) error {
 
   // confirm that spatialite extension is loaded
   if hasDBSpatialite(db) == false {
     return fmt.Errorf("spatialite is not loaded")
   }
 
+  precision := 15 // spatialite default
+  if simp.precision > 0 {
+    precision = simp.precision
+  }
+
   routes, rErr := db.Query(
-    "select route_id, direction_id, asGeoJSON(geom)," +
-    "asGeoJSON(stopgeom), asGeoJSON(pathgeom) from routes_geo;")
+    "select route_id, direction_id, asGeoJSON(geom, ?1)," +
+    "asGeoJSON(stopgeom, ?1), asGeoJSON(pathgeom, ?1) from routes_geo;",
+    precision)
   if rErr != nil {
     return fmt.Errorf("could not query routes_geo [%s]", rErr)
   }
 
-  var id, direc, rteGeo, rteStopGeo, rtePathGeo string
+  var id, direc string
+  var rteGeo, rteStopGeo, rtePathGeo sql.NullString // null, if failed
   for routes.Next() {
     if sErr := routes.Scan(&id, &direc, &rteGeo, &rteStopGeo, &rtePathGeo);
       sErr != nil {
@@ -202,42 +210,63 @@ func exportGeoJSONRoutes(dir string, db *sql.DB) error {
     }
 
     // write route line geojson
-    if wlErr := ioutil.WriteFile(fmt.Sprintf(
-      "%sroute-%s-dir-%s-line.geojson",
-      dir, id, direc), []byte(rteGeo), 0666);
-      wlErr != nil {
-        return fmt.Errorf("failed to write route line geojson file [%s]", wlErr)
+    if rteGeo.Valid {
+      if wlErr := ioutil.WriteFile(fmt.Sprintf(
+        "%sroute-%s-dir-%s-line.geojson",
+        dir, id, direc), []byte(rteGeo.String), 0666);
+        wlErr != nil {
+          return fmt.Errorf("failed to write route line geojson file [%s]", wlErr)
+      }
     }
 
     // write route stop geojson
-    if wsErr := ioutil.WriteFile(fmt.Sprintf(
-      "%sroute-%s-dir-%s-stop.geojson",
-      dir, id, direc), []byte(rteStopGeo), 0666);
-      wsErr != nil {
-        return fmt.Errorf("failed to write route stop geojson file [%s]", wsErr)
+    if rteStopGeo.Valid {
+      if wsErr := ioutil.WriteFile(fmt.Sprintf(
+        "%sroute-%s-dir-%s-stop.geojson",
+        dir, id, direc), []byte(rteStopGeo.String), 0666);
+        wsErr != nil {
+          return fmt.Errorf("failed to write route stop geojson file [%s]", wsErr)
+      }
     }
 
-    // write route path geojson
-    if wpErr := ioutil.WriteFile(fmt.Sprintf(
-      "%sroute-%s-dir-%s-path.geojson",
-      dir, id, direc), []byte(rtePathGeo), 0666);
-      wpErr != nil {
-        return fmt.Errorf("failed to write route path geojson file [%s]", wpErr)
+    // write route path geojson (skip, if failed, see "geom_error")
+    if rtePathGeo.Valid {
+      if wpErr := ioutil.WriteFile(fmt.Sprintf(
+        "%sroute-%s-dir-%s-path.geojson",
+        dir, id, direc), []byte(rtePathGeo.String), 0666);
+        wpErr != nil {
+          return fmt.Errorf("failed to write route path geojson file [%s]", wpErr)
+      }
     }
   }
 
   return nil
 }
 
-// exportGeoJSONTransfers Helper: Export GeoJSON for "transfers" table.
-func exportGeoJSONTransfers(dir string, db *sql.DB) error {
+// exportGeoJSONTransfers Helper: Export GeoJSON for "transfers" table,
+// and "transfers_generated" (if exists), with "origin" property ("gtfs",
+// or "generated"), with coordinates quantized with simp.
+func exportGeoJSONTransfers(dir string, db *sql.DB,
+  simp shapeSimplifier) error {
+
+  // union of existing transfers tables
+  var union []string
+  if hasDBTable(db, "transfers") {
+    union = append(union, "select from_stop_id, to_stop_id, " +
+      "transfer_type, 'gtfs' as origin from 'transfers'")
+  }
+  if hasDBTable(db, "transfers_generated") {
+    union = append(union, "select from_stop_id, to_stop_id, " +
+      "transfer_type, 'generated' as origin from 'transfers_generated'")
+  }
 
   // retrieve all transfers w/ stop
   transfers, transErr := db.Query(
     "select t.'from_stop_id', t.'to_stop_id', t.'transfer_type', " +
+    "t.'origin', " +
     "sf.'stop_lat' as sflat, sf.'stop_lon' as sflon, " +
     "st.'stop_lat' as stlat, st.'stop_lon' as stlon " +
-    "from 'transfers' t " +
+    "from (" + strings.Join(union, " union all ") + ") t " +
     "left join 'stops' sf on t.'from_stop_id' = sf.'stop_id' " +
     "left join 'stops' st on t.'to_stop_id' = st.'stop_id' " +
     "where t.'from_stop_id' != t.'to_stop_id';")
@@ -246,13 +275,13 @@ func exportGeoJSONTransfers(dir string, db *sql.DB) error {
   }
   defer transfers.Close()
 
-  var from, to string
+  var from, to, origin string
   var trans int
   var flat, flng, tlat, tlng float64 // placeholder for cols
   var features []jsony
   for transfers.Next() {
     if scanErr := transfers.Scan(
-      &from, &to, &trans, &flat, &flng, &tlat, &tlng);
+      &from, &to, &trans, &origin, &flat, &flng, &tlat, &tlng);
       scanErr != nil {
         return fmt.Errorf("failed to scan transfers query [%s]", scanErr)
     }
@@ -264,12 +293,13 @@ func exportGeoJSONTransfers(dir string, db *sql.DB) error {
         "from_stop_id": from,
         "to_stop_id": to,
         "transfer_type": trans,
+        "origin": origin,
       },
       "geometry": jsony{
         "type": "LineString",
         "coordinates": [2][2]float64{
-          [2]float64{flng, flat},
-          [2]float64{tlng, tlat},
+          [2]float64{simp.round(flng), simp.round(flat)},
+          [2]float64{simp.round(tlng), simp.round(tlat)},
         },
       },
     }
@@ -294,3 +324,175 @@ func exportGeoJSONTransfers(dir string, db *sql.DB) error {
 
   return nil
 }
+
+// exportGeoJSONPatterns Helper: Export GeoJSON for "patterns" table, as
+// its shape (or straight lines between its stops, if without a shape),
+// with shapes simplified (and quantized) with simp.
+func exportGeoJSONPatterns(dir string, db *sql.DB,
+  simp shapeSimplifier) error {
+
+  patterns, pErr := queryPatterns(db)
+  if pErr != nil {
+    return fmt.Errorf("queryPatterns() %s", pErr)
+  }
+
+  // retrieve shape lines (if "shapes" table exists)
+  lines := map[string][][2]float64{}
+  if hasDBTable(db, "shapes") {
+    shapes, sErr := queryShapes(db)
+    if sErr != nil {
+      return fmt.Errorf("queryShapes() %s", sErr)
+    }
+    for _, s := range shapes {
+      lines[s.id] = s.points
+    }
+  }
+
+  // retrieve stop points
+  points := map[string][2]float64{}
+  stops, stopsErr := db.Query("select stop_id, cast(stop_lon as real), " +
+    "cast(stop_lat as real) from stops where stop_lat != '';")
+  if stopsErr != nil {
+    return fmt.Errorf("failed to select stops [%s]", stopsErr)
+  }
+  for stops.Next() {
+    var id string
+    var pt [2]float64
+    if scanErr := stops.Scan(&id, &pt[0], &pt[1]); scanErr != nil {
+      stops.Close()
+      return fmt.Errorf("failed to scan stops query [%s]", scanErr)
+    }
+    points[id] = pt
+  }
+  stops.Close()
+
+  var features []jsony
+  for _, p := range patterns {
+    line, ok := lines[p.shapeID]
+    if ok == false { // straight lines between stops
+      line = nil
+      for _, s := range p.stops {
+        if pt, ok := points[s]; ok {
+          line = append(line, pt)
+        }
+      }
+    }
+    if len(line) < 2 {
+      continue // not a line
+    }
+
+    features = append(features, jsony{
+      "type": "Feature",
+      "properties": jsony{
+        "pattern_id":   p.id,
+        "route_id":     p.routeID,
+        "direction_id": p.directionID,
+        "shape_id":     p.shapeID,
+        "name":         p.name,
+        "num_stops":    len(p.stops),
+        "num_trips":    p.numTrips,
+        "is_primary":   p.isPrimary,
+      },
+      "geometry": jsony{
+        "type": "LineString",
+        "coordinates": simp.apply(line),
+      },
+    })
+  }
+
+  // create and write geojson "FeatureCollection"
+  if wjErr := writeJSON(dir+"all-patterns.geojson", jsony{
+      "type": "FeatureCollection",
+      "features": features,
+    }); wjErr != nil {
+    return fmt.Errorf("writeJSON() %s", wjErr)
+  }
+
+  return nil
+}
+
+// exportGeoJSONSegments Helper: Export GeoJSON for "segments" table, as
+// the part of its shape between stops (or straight lines between stops,
+// without a shape), colored by average speed ("stroke"), with coordinates
+// simplified/quantized with simp.
+func exportGeoJSONSegments(dir string, db *sql.DB,
+  simp shapeSimplifier) error {
+
+  // retrieve shapes (to cut each segment from)
+  shapes := map[string]*refShape{}
+  if hasDBTable(db, "shapes") {
+    var sErr error
+    if shapes, sErr = queryRefShapes(db); sErr != nil {
+      return fmt.Errorf("queryRefShapes() %s", sErr)
+    }
+  }
+
+  segments, segErr := db.Query(`
+    select g.segment_id, g.from_stop_id, g.to_stop_id, g.distance,
+      g.num_trips, g.avg_run_secs, g.avg_speed,
+      coalesce(g.shape_id, ''), coalesce(g.shape_start, 0),
+      coalesce(g.shape_end, 0),
+      cast(sf.stop_lon as real), cast(sf.stop_lat as real),
+      cast(st.stop_lon as real), cast(st.stop_lat as real)
+    from segments g
+      join stops sf on sf.stop_id = g.from_stop_id
+      join stops st on st.stop_id = g.to_stop_id
+    order by g.segment_id;`)
+  if segErr != nil {
+    return fmt.Errorf("failed to select segments joined stops [%s]", segErr)
+  }
+  defer segments.Close()
+
+  var features []jsony
+  for segments.Next() {
+    var id, numTrips int
+    var from, to, shapeID string
+    var dist, shapeStart, shapeEnd, flng, flat, tlng, tlat float64
+    var avgRun, avgSpeed sql.NullFloat64 // null, if not timed
+    if scanErr := segments.Scan(&id, &from, &to, &dist, &numTrips,
+      &avgRun, &avgSpeed, &shapeID, &shapeStart, &shapeEnd, &flng, &flat,
+      &tlng, &tlat); scanErr != nil {
+      return fmt.Errorf("failed to scan segments query [%s]", scanErr)
+    }
+
+    // along shape (if any), otherwise straight line
+    coords := simp.apply([][2]float64{{flng, flat}, {tlng, tlat}})
+    if s, ok := shapes[shapeID]; ok {
+      coords = simp.apply(s.cut(shapeStart, shapeEnd))
+    }
+
+    var run, speed interface{}
+    if avgSpeed.Valid {
+      run, speed = avgRun.Float64, avgSpeed.Float64
+    }
+
+    features = append(features, jsony{
+      "type": "Feature",
+      "properties": jsony{
+        "segment_id":   id,
+        "from_stop_id": from,
+        "to_stop_id":   to,
+        "distance":     dist,
+        "num_trips":    numTrips,
+        "avg_run_secs": run,
+        "avg_speed":    speed,
+        "stroke":       speedColor(speed),
+        "stroke-width": 3,
+      },
+      "geometry": jsony{
+        "type": "LineString",
+        "coordinates": coords,
+      },
+    })
+  }
+
+  // create and write geojson "FeatureCollection"
+  if wjErr := writeJSON(dir+"all-segments.geojson", jsony{
+      "type": "FeatureCollection",
+      "features": features,
+    }); wjErr != nil {
+    return fmt.Errorf("writeJSON() %s", wjErr)
+  }
+
+  return nil
+}
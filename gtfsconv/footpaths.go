@@ -0,0 +1,173 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "database/sql"
+)
+
+// footStop Type Helper: stop (or platform), for generating footpaths.
+type footStop struct {
+  id        string
+  name      string
+  station   string // parent_station (or empty)
+  lat, lon  float64
+}
+
+// buildFootpaths generates walking transfers between stops (location_type
+// 0, or empty) within radius (in meters), into "transfers_generated"
+// (with "generated" = 1), with min_transfer_time as the walk time (at
+// walkSpeed, in m/s). Stops of different parent stations are never
+// linked (stations own their transfers), nor are pairs in "transfers".
+func buildFootpaths(db *sql.DB, radius, walkSpeed float64) error {
+
+  // (re)create "transfers_generated" table
+  if _, cErr := db.Exec(`
+    drop table if exists transfers_generated;
+    create table transfers_generated (from_stop_id text, to_stop_id text,
+      transfer_type integer, min_transfer_time integer, distance real,
+      generated integer default 1);`); cErr != nil {
+    return fmt.Errorf("failed to create table `transfers_generated` [%s]",
+      cErr)
+  }
+
+  stops, sErr := queryFootStops(db)
+  if sErr != nil {
+    return fmt.Errorf("queryFootStops() %s", sErr)
+  }
+
+  // existing transfers (never duplicated, nor overridden)
+  existing := map[[2]string]bool{}
+  if hasDBTable(db, "transfers") {
+    rows, qErr := db.Query("select from_stop_id, to_stop_id from transfers;")
+    if qErr != nil {
+      return fmt.Errorf("failed to select transfers [%s]", qErr)
+    }
+    for rows.Next() {
+      var k [2]string
+      if sErr := rows.Scan(&k[0], &k[1]); sErr != nil {
+        rows.Close()
+        return fmt.Errorf("failed to scan transfers [%s]", sErr)
+      }
+      existing[k] = true
+    }
+    rows.Close()
+  }
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  if pErr := eachNearbyPair(stops, radius, func(i, j int, dist float64) error {
+    a, b := stops[i], stops[j]
+    if existing[[2]string{a.id, b.id}] ||
+      (a.station != "" && b.station != "" && a.station != b.station) {
+      return nil
+    }
+
+    if _, iErr := tx.Exec("insert into transfers_generated " +
+      "(from_stop_id, to_stop_id, transfer_type, min_transfer_time, " +
+      "distance) values (?, ?, 2, ?, ?);", a.id, b.id,
+      int(math.Ceil(dist / walkSpeed)), math.Round(dist * 10) / 10);
+      iErr != nil {
+      return fmt.Errorf("failed to insert into `transfers_generated` [%s]",
+        iErr)
+    }
+    return nil
+  }); pErr != nil {
+    return pErr
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create index transfers_generated_idx
+      on transfers_generated (from_stop_id);`); ciErr != nil {
+    return fmt.Errorf("failed add index(es) to transfers_generated [%s]",
+      ciErr)
+  }
+
+  return nil
+}
+
+// eachNearbyPair Helper: Call fn for each (ordered) pair of stops within
+// radius (in meters), using a grid of stops (cells of radius).
+func eachNearbyPair(stops []footStop, radius float64,
+  fn func(i, j int, dist float64) error) error {
+  if len(stops) == 0 {
+    return nil
+  }
+
+  // grid cells (in degrees), of at least radius (at the highest latitude)
+  maxLat := 0.0
+  for _, s := range stops {
+    maxLat = math.Max(maxLat, math.Abs(s.lat))
+  }
+  cellLat := radius / earthRadius * 180 / math.Pi
+  cellLon := cellLat / math.Max(0.01, math.Cos(maxLat * math.Pi / 180))
+  cellOf := func(s footStop) [2]int {
+    return [2]int{int(math.Floor(s.lat / cellLat)),
+      int(math.Floor(s.lon / cellLon))}
+  }
+  grid := map[[2]int][]int{}
+  for i, s := range stops {
+    c := cellOf(s)
+    grid[c] = append(grid[c], i)
+  }
+
+  // each stop, with stops of neighboring cells
+  for i, a := range stops {
+    c := cellOf(a)
+    for dy := -1; dy <= 1; dy++ {
+      for dx := -1; dx <= 1; dx++ {
+        for _, j := range grid[[2]int{c[0] + dy, c[1] + dx}] {
+          if i == j {
+            continue
+          }
+          b := stops[j]
+          if dist := haversine(a.lat, a.lon, b.lat, b.lon); dist <= radius {
+            if fErr := fn(i, j, dist); fErr != nil {
+              return fErr
+            }
+          }
+        }
+      }
+    }
+  }
+
+  return nil
+}
+
+// queryFootStops Helper: Retrieve stops (location_type 0, or empty) with
+// coordinates, and their name, and parent_station (if any).
+func queryFootStops(db *sql.DB) ([]footStop, error) {
+
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select stop_id, %s, %s, cast(stop_lat as real), cast(stop_lon as real)
+    from stops
+    where stop_lat != '' and stop_lon != '' and %s in ('', '0')
+    order by stop_id;`,
+    optDBTableCol(db, "", "stops", "stop_name"),
+    optDBTableCol(db, "", "stops", "parent_station"),
+    optDBTableCol(db, "", "stops", "location_type")))
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select stops [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var stops []footStop
+  for rows.Next() {
+    var s footStop
+    if sErr := rows.Scan(&s.id, &s.name, &s.station, &s.lat,
+      &s.lon); sErr != nil {
+      return nil, fmt.Errorf("failed to scan stops [%s]", sErr)
+    }
+    stops = append(stops, s)
+  }
+
+  return stops, nil
+}
@@ -0,0 +1,138 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "strings"
+  "database/sql"
+)
+
+// expandFrequencies creates "trip_instances" table, with every actual
+// trip run (regular trips, and each departure of frequency-based trips),
+// and "stop_times_expanded" table, with "stop_times" for every run.
+// note: frequency-based runs get synthetic trip ids, "trip_id@HH:MM:SS",
+//       linked back by "template_trip_id" to the "frequencies" trip.
+// note: for exact_times = 0 (headway-based) frequencies, runs are
+//       scheduled at nominal "start_time + n * headway_secs" times,
+//       and marked "is_exact" = 0 (otherwise, 1).
+// note: a run starting at the same time from overlapping frequencies
+//       (of the same trip) is kept once.
+func expandFrequencies(db *sql.DB) error {
+
+  // sanity check for derived "seconds" columns
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return rErr
+  }
+
+  // (re)create "trip_instances" table
+  if _, cErr := db.Exec(`
+    drop table if exists trip_instances;
+    create table trip_instances (trip_id text, template_trip_id text,
+      start_time text, start_secs integer, exact_times integer,
+      is_exact integer);`);
+    cErr != nil {
+    return fmt.Errorf("failed to create table `trip_instances` [%s]", cErr)
+  }
+
+  // insert each departure of frequency-based trips,
+  // from start_time until (not including) end_time
+  // note: end_time before start_time is read as over-midnight
+  if _, fErr := db.Exec(fmt.Sprintf(`
+    with recursive instances (trip_id, start_secs, end_secs,
+      headway, exact_times) as (
+      select trip_id, start_secs,
+        case when end_secs < start_secs then end_secs + 86400
+          else end_secs end,
+        cast(headway_secs as int),
+        coalesce(cast(nullif(exact_times, '') as int), 0)
+      from frequencies
+      where start_secs is not null and end_secs is not null
+        and cast(headway_secs as int) > 0
+
+      union all
+      select trip_id, start_secs + headway, end_secs, headway, exact_times
+      from instances where start_secs + headway < end_secs)
+
+    insert into trip_instances
+    select trip_id || '@' || %[1]s, trip_id, %[1]s, start_secs,
+      max(exact_times), max(exact_times)
+    from instances group by trip_id, start_secs;`,
+    sqlGTFSTime("start_secs"))); fErr != nil {
+    return fmt.Errorf("failed to expand frequencies [%s]", fErr)
+  }
+
+  // insert regular (non-frequency) trips, as their own instance
+  if _, rErr := db.Exec(fmt.Sprintf(`
+    insert into trip_instances
+    select trip_id, trip_id, %s, start_secs, null, 1 from
+      (select trip_id, min(coalesce(departure_secs, arrival_secs)) as start_secs
+      from stop_times
+      where trip_id not in (select trip_id from frequencies)
+      group by trip_id);`, sqlGTFSTime("start_secs"))); rErr != nil {
+    return fmt.Errorf("failed to insert regular trips [%s]", rErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create unique index ti_trip_idx on trip_instances (trip_id);
+    create index ti_template_idx on trip_instances (template_trip_id);`);
+    ciErr != nil {
+    return fmt.Errorf("failed add index(es) to trip_instances [%s]", ciErr)
+  }
+
+  // prepare "stop_times_expanded" columns, based on "stop_times",
+  // shifting times of frequency-based trips to each instance
+  stCols, scErr := getDBTableCols(db, "stop_times")
+  if scErr != nil {
+    return fmt.Errorf("getDBTableCols() %s", scErr)
+  }
+
+  var freqCols []string
+  for _, col := range stCols {
+    switch col {
+      case "trip_id":
+        col = "ti.trip_id"
+      case "arrival_secs", "departure_secs":
+        col = fmt.Sprintf("st.%s + ti.start_secs - f.first_secs", col)
+      case "arrival_time", "departure_time":
+        secs := fmt.Sprintf("(st.%s + ti.start_secs - f.first_secs)",
+          strings.Replace(col, "_time", "_secs", 1))
+        col = fmt.Sprintf("coalesce(%s, st.%s)", sqlGTFSTime(secs), col)
+      default:
+        col = "st." + col
+    }
+    freqCols = append(freqCols, col)
+  }
+
+  // (re)create "stop_times_expanded" table
+  if _, cErr := db.Exec(fmt.Sprintf(`
+    drop table if exists stop_times_expanded;
+    create table stop_times_expanded as
+    select st.*, st.trip_id as template_trip_id, null as exact_times,
+      1 as is_exact
+    from stop_times st
+    where st.trip_id not in (select trip_id from frequencies)
+
+    union all
+    select %s, ti.template_trip_id, ti.exact_times, ti.is_exact
+    from trip_instances ti
+      join stop_times st on st.trip_id = ti.template_trip_id
+      join (select trip_id,
+          min(coalesce(departure_secs, arrival_secs)) as first_secs
+        from stop_times
+        where trip_id in (select trip_id from frequencies)
+        group by trip_id) f on f.trip_id = ti.template_trip_id
+    where ti.trip_id != ti.template_trip_id;`,
+    strings.Join(freqCols, ", "))); cErr != nil {
+    return fmt.Errorf("failed to create table `stop_times_expanded` [%s]", cErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create index ste_trip_idx on stop_times_expanded (trip_id);
+    create index ste_stop_idx on stop_times_expanded (stop_id);
+    create index ste_template_idx on stop_times_expanded (template_trip_id);
+    create index ste_departure_secs_idx
+      on stop_times_expanded (departure_secs);`); ciErr != nil {
+    return fmt.Errorf("failed add index(es) to stop_times_expanded [%s]", ciErr)
+  }
+
+  return nil
+}
@@ -0,0 +1,72 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "database/sql"
+)
+
+func TestExpandFrequencies(t *testing.T) {
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1) // each connection is its own db
+  defer db.Close()
+
+  // F: overlapping frequencies (both start a run at 07:00:00),
+  // H: headway-based, R: regular trip
+  if _, eErr := db.Exec(`
+    create table stop_times (trip_id text, stop_id text, stop_sequence text,
+      arrival_time text, departure_time text, arrival_secs integer,
+      departure_secs integer);
+    create table frequencies (trip_id text, start_time text, end_time text,
+      headway_secs text, exact_times text, start_secs integer,
+      end_secs integer);
+    insert into stop_times values
+      ('F', 'A', '1', '00:00:00', '00:00:00', 0, 0),
+      ('F', 'B', '2', '00:10:00', '00:10:00', 600, 600),
+      ('H', 'A', '1', '00:00:00', '00:00:00', 0, 0),
+      ('R', 'A', '1', '09:00:00', '09:00:00', 32400, 32400);
+    insert into frequencies values
+      ('F', '06:00:00', '07:01:00', '3600', '1', 21600, 25260),
+      ('F', '07:00:00', '08:00:00', '1800', '1', 25200, 28800),
+      ('H', '06:00:00', '07:00:00', '1800', '0', 21600, 25200);`);
+    eErr != nil {
+    t.Fatalf("db.Exec() %s", eErr)
+  }
+
+  if fErr := expandFrequencies(db); fErr != nil {
+    t.Fatalf("expandFrequencies() %s", fErr)
+  }
+
+  rows, qErr := db.Query("select trip_id, template_trip_id, is_exact " +
+    "from trip_instances order by start_secs, trip_id;")
+  if qErr != nil {
+    t.Fatalf("db.Query() %s", qErr)
+  }
+  defer rows.Close()
+
+  var got []string
+  for rows.Next() {
+    var id, template string
+    var exact int
+    if sErr := rows.Scan(&id, &template, &exact); sErr != nil {
+      t.Fatalf("rows.Scan() %s", sErr)
+    }
+    got = append(got, fmt.Sprintf("%s %s %d", id, template, exact))
+  }
+  want := []string{"F@06:00:00 F 1", "H@06:00:00 H 0", "H@06:30:00 H 0",
+    "F@07:00:00 F 1", "F@07:30:00 F 1", "R R 1"}
+  if reflect.DeepEqual(got, want) == false {
+    t.Errorf("trip_instances = %q, want %q", got, want)
+  }
+
+  var n int
+  if qErr := db.QueryRow("select count(*) from stop_times_expanded " +
+    "where trip_id = 'F@07:00:00';").Scan(&n); qErr != nil || n != 2 {
+    t.Errorf("stop_times_expanded F@07:00:00 = %d rows (%v), want 2", n,
+      qErr)
+  }
+}
@@ -0,0 +1,271 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "io"
+  "math"
+  "strconv"
+  "strings"
+  "time"
+  "database/sql/driver"
+
+  "github.com/mattn/go-sqlite3"
+)
+
+// registerFunctions registers custom GTFS SQL functions on an sqlite3
+// connection (see "sqlite3_gtfs" driver), which are available to any
+// query, both during Build and when opening the db with Open():
+//
+//   gtfs_time_to_secs(time)          GTFS "H:MM:SS" to seconds since midnight
+//   secs_to_gtfs_time(secs)          seconds since midnight to "HH:MM:SS"
+//   haversine(lat1, lon1, lat2, lon2)   distance (in meters)
+//   service_active(service_id, date) 1 if service runs on "YYYYMMDD" date
+//   polyline_encode(lat, lon)        aggregate, encoded polyline of points
+//   route_color_contrast(route_color, route_text_color)
+//                                    WCAG contrast ratio (1 to 21)
+//
+// note: invalid (or null) arguments return null.
+func registerFunctions(conn *sqlite3.SQLiteConn) error {
+  funcs := []struct {
+    name string
+    impl interface{}
+    pure bool
+  }{
+    {"gtfs_time_to_secs", sqlGTFSTimeToSecs, true},
+    {"secs_to_gtfs_time", sqlSecsToGTFSTime, true},
+    {"haversine", sqlHaversine, true},
+    {"route_color_contrast", sqlRouteColorContrast, true},
+
+    // service_active() queries the db, so it is not "pure"
+    {"service_active", func(serviceID, date interface{}) (interface{}, error) {
+      return sqlServiceActive(conn, serviceID, date)
+    }, false},
+  }
+
+  for _, f := range funcs {
+    if rErr := conn.RegisterFunc(f.name, f.impl, f.pure); rErr != nil {
+      return fmt.Errorf("failed to register %s() [%s]", f.name, rErr)
+    }
+  }
+
+  if rErr := conn.RegisterAggregator("polyline_encode",
+    newPolylineAggregator, true); rErr != nil {
+    return fmt.Errorf("failed to register polyline_encode() [%s]", rErr)
+  }
+
+  return nil
+}
+
+// sqlToFloat Helper: Convert sql function argument into float64.
+func sqlToFloat(v interface{}) (float64, bool) {
+  switch n := v.(type) {
+    case int64: return float64(n), true
+    case float64: return n, true
+    case string:
+      f, pErr := strconv.ParseFloat(strings.TrimSpace(n), 64)
+      return f, pErr == nil
+    case []byte: return sqlToFloat(string(n))
+  }
+  return 0, false
+}
+
+// sqlToString Helper: Convert sql function argument into string.
+func sqlToString(v interface{}) (string, bool) {
+  switch s := v.(type) {
+    case string: return s, true
+    case []byte: return string(s), true
+    case int64: return strconv.FormatInt(s, 10), true
+    case float64: return strconv.FormatFloat(s, 'f', -1, 64), true
+  }
+  return "", false
+}
+
+// sqlGTFSTimeToSecs implements gtfs_time_to_secs(time).
+func sqlGTFSTimeToSecs(t interface{}) interface{} {
+  s, ok := sqlToString(t)
+  if ok == false {
+    return nil
+  }
+
+  secs, pErr := parseGTFSTime(strings.TrimSpace(s))
+  if pErr != nil {
+    return nil
+  }
+
+  return int64(secs)
+}
+
+// sqlSecsToGTFSTime implements secs_to_gtfs_time(secs).
+func sqlSecsToGTFSTime(secs interface{}) interface{} {
+  f, ok := sqlToFloat(secs)
+  if ok == false || f < 0 {
+    return nil
+  }
+
+  return FormatClock(int(f))
+}
+
+// sqlHaversine implements haversine(lat1, lon1, lat2, lon2).
+func sqlHaversine(lat1, lon1, lat2, lon2 interface{}) interface{} {
+  var c [4]float64
+  for i, v := range [...]interface{}{lat1, lon1, lat2, lon2} {
+    f, ok := sqlToFloat(v)
+    if ok == false {
+      return nil
+    }
+    c[i] = f
+  }
+
+  return haversine(c[0], c[1], c[2], c[3])
+}
+
+// sqlRouteColorContrast implements route_color_contrast(color, text_color).
+// note: empty colors use GTFS defaults (white route, black text).
+func sqlRouteColorContrast(color, textColor interface{}) interface{} {
+  c, _ := sqlToString(color)
+  tc, _ := sqlToString(textColor)
+  if c = strings.TrimSpace(c); c == "" {
+    c = "FFFFFF"
+  }
+  if tc = strings.TrimSpace(tc); tc == "" {
+    tc = "000000"
+  }
+
+  l1, ok1 := relativeLuminance(c)
+  l2, ok2 := relativeLuminance(tc)
+  if ok1 == false || ok2 == false {
+    return nil
+  }
+
+  return (math.Max(l1, l2) + 0.05) / (math.Min(l1, l2) + 0.05)
+}
+
+// relativeLuminance Helper: WCAG relative luminance of hex "RRGGBB" color.
+func relativeLuminance(hex string) (float64, bool) {
+  hex = strings.TrimPrefix(hex, "#")
+  rgb, pErr := strconv.ParseUint(hex, 16, 32)
+  if len(hex) != 6 || pErr != nil {
+    return 0, false
+  }
+
+  var l float64
+  for i, w := range [...]float64{0.2126, 0.7152, 0.0722} {
+    c := float64(rgb >> uint(16-8*i) & 0xFF) / 255
+    if c <= 0.03928 {
+      c = c / 12.92
+    } else {
+      c = math.Pow((c + 0.055) / 1.055, 2.4)
+    }
+    l += w * c
+  }
+
+  return l, true
+}
+
+// sqlServiceActive implements service_active(service_id, date),
+// based on "calendar" and "calendar_dates" (not limited by "service_dates").
+// note: date can be GTFS "YYYYMMDD", or "YYYY-MM-DD".
+func sqlServiceActive(conn *sqlite3.SQLiteConn,
+  serviceID, date interface{}) (interface{}, error) {
+  sid, ok1 := sqlToString(serviceID)
+  d, ok2 := sqlToString(date)
+  if ok1 == false || ok2 == false {
+    return nil, nil
+  }
+
+  d = strings.Replace(d, "-", "", -1)
+  day, pErr := time.Parse("20060102", d)
+  if pErr != nil {
+    return nil, nil
+  }
+
+  // determine which calendar tables exist
+  tables := map[string]bool{}
+  names, tErr := connQueryStrings(conn,
+    "select name from sqlite_master where type = 'table' " +
+    "and name in ('calendar', 'calendar_dates');")
+  if tErr != nil {
+    return nil, tErr
+  }
+  for _, n := range names {
+    tables[n] = true
+  }
+
+  // exceptions take precedence (1 = added, 2 = removed)
+  if tables["calendar_dates"] {
+    exc, eErr := connQueryStrings(conn,
+      "select cast(exception_type as int) from calendar_dates " +
+      "where service_id = ? and date = ? limit 1;", sid, d)
+    switch {
+      case eErr != nil: return nil, eErr
+      case len(exc) > 0: return exc[0] == "1", nil
+    }
+  }
+
+  // otherwise, service runs on weekday, within start/end dates
+  if tables["calendar"] {
+    weekday := strings.ToLower(day.Weekday().String())
+    cal, cErr := connQueryStrings(conn, fmt.Sprintf(
+      "select 1 from calendar where service_id = ? " +
+      "and ? between start_date and end_date " +
+      "and cast(%s as int) = 1 limit 1;", weekday), sid, d)
+    if cErr != nil {
+      return nil, cErr
+    }
+    return len(cal) > 0, nil
+  }
+
+  return false, nil
+}
+
+// connQueryStrings Helper: Query directly on an sqlite3 connection
+// (e.g., within sql functions), returning first column of each row.
+func connQueryStrings(conn *sqlite3.SQLiteConn,
+  query string, args ...driver.Value) ([]string, error) {
+  rows, qErr := conn.Query(query, args)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to query [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var list []string
+  dest := make([]driver.Value, len(rows.Columns()))
+  for {
+    if nErr := rows.Next(dest); nErr == io.EOF {
+      break
+    } else if nErr != nil {
+      return nil, fmt.Errorf("failed to scan [%s]", nErr)
+    }
+
+    s, _ := sqlToString(dest[0])
+    list = append(list, s)
+  }
+
+  return list, nil
+}
+
+// polylineAggregator implements polyline_encode(lat, lon) aggregate.
+// note: points are encoded in row order, e.g., use an ordered
+//       subquery, or "polyline_encode(lat, lon order by seq)".
+type polylineAggregator struct {
+  points [][2]float64
+}
+
+// newPolylineAggregator creates a new polyline_encode() aggregate.
+func newPolylineAggregator() *polylineAggregator {
+  return &polylineAggregator{}
+}
+
+// Step adds a lat/lon point (invalid points are skipped).
+func (p *polylineAggregator) Step(lat, lon interface{}) {
+  la, ok1 := sqlToFloat(lat)
+  lo, ok2 := sqlToFloat(lon)
+  if ok1 && ok2 {
+    p.points = append(p.points, [2]float64{la, lo})
+  }
+}
+
+// Done returns the encoded polyline.
+func (p *polylineAggregator) Done() string {
+  return encodePolyline(p.points)
+}
@@ -0,0 +1,51 @@
+package gtfsconv
+
+import (
+  "math"
+)
+
+// earthRadius: mean earth radius (in meters)
+const earthRadius = 6371008.8
+
+// haversine Helper: Great-circle distance (in meters) between two
+// lat/lon coordinates (in degrees).
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+  rad := math.Pi / 180
+  dLat := (lat2 - lat1) * rad
+  dLon := (lon2 - lon1) * rad
+
+  a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+    math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+  return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// encodePolyline Helper: Encode lat/lon points into Google's
+// "encoded polyline algorithm format" (precision of 5 decimals).
+func encodePolyline(points [][2]float64) string {
+  var buf []byte
+  var prevLat, prevLon int64
+
+  // encode each signed value, as 5-bit chunks
+  encode := func(v int64) {
+    u := uint64(v << 1)
+    if v < 0 {
+      u = ^u
+    }
+    for u >= 0x20 {
+      buf = append(buf, byte((0x20 | (u & 0x1f)) + 63))
+      u >>= 5
+    }
+    buf = append(buf, byte(u + 63))
+  }
+
+  for _, pt := range points {
+    lat := int64(math.Round(pt[0] * 1e5))
+    lon := int64(math.Round(pt[1] * 1e5))
+    encode(lat - prevLat)
+    encode(lon - prevLon)
+    prevLat, prevLon = lat, lon
+  }
+
+  return string(buf)
+}
@@ -0,0 +1,286 @@
+package gtfsconv
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "math"
+  "database/sql"
+)
+
+// shapeLine Type Helper: points of a shape, as [lon, lat].
+type shapeLine struct {
+  id      string
+  points  [][2]float64
+}
+
+// queryShapes Helper: Retrieve all shapes (points ordered by sequence).
+func queryShapes(db *sql.DB) ([]shapeLine, error) {
+  rows, qErr := db.Query(`
+    select shape_id, cast(shape_pt_lon as real), cast(shape_pt_lat as real)
+    from shapes order by shape_id, cast(shape_pt_sequence as int);`)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select shapes [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var shapes []shapeLine
+  var id string
+  var lon, lat float64 // placeholder for cols
+  for rows.Next() {
+    if sErr := rows.Scan(&id, &lon, &lat); sErr != nil {
+      return nil, fmt.Errorf("failed to scan shapes [%s]", sErr)
+    }
+
+    // group by shape
+    if n := len(shapes); n == 0 || shapes[n-1].id != id {
+      shapes = append(shapes, shapeLine{id: id})
+    }
+    s := &shapes[len(shapes)-1]
+    s.points = append(s.points, [2]float64{lon, lat})
+  }
+
+  return shapes, nil
+}
+
+// bbox Helper: Bounding box [minx, miny, maxx, maxy] of points.
+func bbox(points [][2]float64) [4]float64 {
+  b := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+  for _, p := range points {
+    b[0], b[1] = math.Min(b[0], p[0]), math.Min(b[1], p[1])
+    b[2], b[3] = math.Max(b[2], p[0]), math.Max(b[3], p[1])
+  }
+  return b
+}
+
+// wkbPoint Helper: Well-Known Binary (little endian) point.
+func wkbPoint(pt [2]float64) []byte {
+  var buf bytes.Buffer
+  buf.WriteByte(1) // little endian
+  binary.Write(&buf, binary.LittleEndian, uint32(1))
+  binary.Write(&buf, binary.LittleEndian, pt)
+  return buf.Bytes()
+}
+
+// wkbLineString Helper: Well-Known Binary (little endian) linestring.
+func wkbLineString(points [][2]float64) []byte {
+  var buf bytes.Buffer
+  buf.WriteByte(1) // little endian
+  binary.Write(&buf, binary.LittleEndian, uint32(2))
+  binary.Write(&buf, binary.LittleEndian, uint32(len(points)))
+  binary.Write(&buf, binary.LittleEndian, points)
+  return buf.Bytes()
+}
+
+// gpkgGeometry Helper: GeoPackage geometry blob (header + WKB), in WGS84,
+// with optional envelope [minx, miny, maxx, maxy] in the header.
+func gpkgGeometry(wkb []byte, env *[4]float64) []byte {
+  var buf bytes.Buffer
+  buf.WriteString("GP")
+  buf.WriteByte(0) // version 1
+
+  // flags: little endian, with (or without) xy envelope
+  if env == nil {
+    buf.WriteByte(0x01)
+  } else {
+    buf.WriteByte(0x03)
+  }
+
+  binary.Write(&buf, binary.LittleEndian, int32(4326)) // srs_id
+  if env != nil { // envelope order is minx, maxx, miny, maxy
+    binary.Write(&buf, binary.LittleEndian,
+      [4]float64{env[0], env[2], env[1], env[3]})
+  }
+
+  buf.Write(wkb)
+  return buf.Bytes()
+}
+
+// buildGeometry creates "stops_geo" and "shapes_geo" tables, without
+// Spatialite, as GeoPackage geometry blobs (WKB, with GeoPackage header)
+// with bounding box columns, and registers them as GeoPackage features.
+// Shapes are simplified (and quantized) with simp.
+func buildGeometry(db *sql.DB, simp shapeSimplifier) error {
+
+  // sanity check for existing spatialite tables
+  if hasDBTable(db, "geometry_columns") {
+    return fmt.Errorf("spatialite tables already exist")
+  }
+
+  if gErr := initGeoPackage(db); gErr != nil {
+    return fmt.Errorf("initGeoPackage() %s", gErr)
+  }
+
+  // (re)create "stops_geo" table
+  if _, cErr := db.Exec(`
+    drop table if exists stops_geo;
+    create table stops_geo (fid integer primary key autoincrement,
+      stop_id text, geom POINT,
+      minx real, miny real, maxx real, maxy real);`); cErr != nil {
+    return fmt.Errorf("failed to create table `stops_geo` [%s]", cErr)
+  }
+
+  // collect stop points
+  rows, qErr := db.Query(`
+    select stop_id, cast(stop_lon as real), cast(stop_lat as real)
+    from stops where stop_lat != '' and stop_lon != '';`)
+  if qErr != nil {
+    return fmt.Errorf("failed to select stops [%s]", qErr)
+  }
+
+  var stops []shapeLine // single point, per stop
+  for rows.Next() {
+    var s shapeLine
+    var pt [2]float64
+    if sErr := rows.Scan(&s.id, &pt[0], &pt[1]); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan stops [%s]", sErr)
+    }
+    s.points = [][2]float64{pt}
+    stops = append(stops, s)
+  }
+  rows.Close()
+
+  if iErr := insertGeometry(db, "stops_geo", "stop_id", stops,
+    func(pts [][2]float64) []byte {
+      return gpkgGeometry(wkbPoint(pts[0]), nil)
+    }); iErr != nil {
+    return fmt.Errorf("insertGeometry() %s", iErr)
+  }
+
+  // (re)create "shapes_geo" table (only, if "shapes" table exists)
+  if hasDBTable(db, "shapes") {
+    if _, cErr := db.Exec(`
+      drop table if exists shapes_geo;
+      create table shapes_geo (fid integer primary key autoincrement,
+        shape_id text, geom LINESTRING,
+        minx real, miny real, maxx real, maxy real);`); cErr != nil {
+      return fmt.Errorf("failed to create table `shapes_geo` [%s]", cErr)
+    }
+
+    shapes, sErr := queryShapes(db)
+    if sErr != nil {
+      return fmt.Errorf("queryShapes() %s", sErr)
+    }
+    for i := range shapes {
+      shapes[i].points = simp.apply(shapes[i].points)
+    }
+
+    if iErr := insertGeometry(db, "shapes_geo", "shape_id", shapes,
+      func(pts [][2]float64) []byte {
+        env := bbox(pts)
+        return gpkgGeometry(wkbLineString(pts), &env)
+      }); iErr != nil {
+      return fmt.Errorf("insertGeometry() %s", iErr)
+    }
+  }
+
+  // add unique indexes, and register as geopackage features
+  for _, t := range [...][3]string{
+    {"stops_geo", "stop_id", "POINT"},
+    {"shapes_geo", "shape_id", "LINESTRING"}} {
+    if hasDBTable(db, t[0]) == false {
+      continue
+    }
+
+    if _, ciErr := db.Exec(fmt.Sprintf(
+      "create unique index %[1]s_idx on %[1]s (%[2]s);", t[0], t[1]));
+      ciErr != nil {
+      return fmt.Errorf("failed add index(es) to %s [%s]", t[0], ciErr)
+    }
+
+    if _, rErr := db.Exec(fmt.Sprintf(`
+      delete from gpkg_contents where table_name = '%[1]s';
+      delete from gpkg_geometry_columns where table_name = '%[1]s';
+
+      insert into gpkg_contents (table_name, data_type, identifier,
+        last_change, min_x, min_y, max_x, max_y, srs_id)
+      select '%[1]s', 'features', '%[1]s',
+        strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', 'now'),
+        min(minx), min(miny), max(maxx), max(maxy), 4326 from %[1]s;
+
+      insert into gpkg_geometry_columns
+      values ('%[1]s', 'geom', '%[2]s', 4326, 0, 0);`, t[0], t[2]));
+      rErr != nil {
+      return fmt.Errorf("failed to register %s geopackage [%s]", t[0], rErr)
+    }
+  }
+
+  return nil
+}
+
+// insertGeometry Helper: Insert geometry rows (with bounding box columns),
+// encoding each list of points with encodeFn.
+func insertGeometry(db *sql.DB, table, idCol string, geoms []shapeLine,
+  encodeFn func([][2]float64) []byte) error {
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  stmt, pErr := tx.Prepare(fmt.Sprintf(
+    "insert into %s (%s, geom, minx, miny, maxx, maxy) " +
+    "values (?, ?, ?, ?, ?, ?);", table, idCol))
+  if pErr != nil {
+    return fmt.Errorf("failed to prepare insert [%s]", pErr)
+  }
+  defer stmt.Close()
+
+  for _, g := range geoms {
+    b := bbox(g.points)
+    if _, iErr := stmt.Exec(g.id, encodeFn(g.points), b[0], b[1], b[2], b[3]);
+      iErr != nil {
+      return fmt.Errorf("failed to insert into `%s` [%s]", table, iErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  return nil
+}
+
+// initGeoPackage Helper: Ensure GeoPackage metadata tables, so that
+// GeoPackage tools (e.g., GDAL/QGIS) can read the geometry tables.
+func initGeoPackage(db *sql.DB) error {
+  if hasDBTable(db, "gpkg_spatial_ref_sys") {
+    return nil // already initialized
+  }
+
+  if _, gErr := db.Exec(`
+    pragma application_id = 1196444487;
+    pragma user_version = 10200;
+
+    create table gpkg_spatial_ref_sys (srs_name text not null,
+      srs_id integer primary key, organization text not null,
+      organization_coordsys_id integer not null,
+      definition text not null, description text);
+
+    insert into gpkg_spatial_ref_sys values
+      ('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', null),
+      ('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', null),
+      ('WGS 84 geodetic', 4326, 'EPSG', 4326,
+        'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,` +
+        `298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],` +
+        `PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],` +
+        `UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],` +
+        `AUTHORITY["EPSG","4326"]]', null);
+
+    create table gpkg_contents (table_name text not null primary key,
+      data_type text not null, identifier text unique,
+      description text default '', last_change datetime not null,
+      min_x double, min_y double, max_x double, max_y double,
+      srs_id integer references gpkg_spatial_ref_sys(srs_id));
+
+    create table gpkg_geometry_columns (table_name text not null,
+      column_name text not null, geometry_type_name text not null,
+      srs_id integer not null, z tinyint not null, m tinyint not null,
+      primary key (table_name, column_name));`); gErr != nil {
+    return fmt.Errorf("failed to create geopackage tables [%s]", gErr)
+  }
+
+  return nil
+}
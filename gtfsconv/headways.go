@@ -0,0 +1,250 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+  "database/sql"
+)
+
+// Headway Type Helper: how often a route/direction departs a stop,
+// within a time-of-day period, on a service date (see Headways).
+type Headway struct {
+  Date            string  // service date (YYYYMMDD)
+  RouteID         string
+  DirectionID     string
+  StopID          string
+  Period          string  // period name, or "all_day"
+  NumTrips        int
+  MinHeadway      int     // in seconds (0, if less than 2 trips)
+  AvgHeadway      float64 // in seconds (0, if less than 2 trips)
+  MaxHeadway      int     // in seconds (0, if less than 2 trips)
+  FirstDeparture  int     // seconds since midnight (of service day)
+  LastDeparture   int     // seconds since midnight (of service day)
+}
+
+// dayTypes: day types (for Headways), and their weekdays
+var dayTypes = map[string][]time.Weekday{
+  "weekday":    {time.Monday, time.Tuesday, time.Wednesday,
+                 time.Thursday, time.Friday},
+  "saturday":   {time.Saturday},
+  "sunday":     {time.Sunday},
+  "monday":     {time.Monday},
+  "tuesday":    {time.Tuesday},
+  "wednesday":  {time.Wednesday},
+  "thursday":   {time.Thursday},
+  "friday":     {time.Friday},
+}
+
+// isDayType Helper: Check if day is a service date (YYYYMMDD),
+// or a day type (e.g., "weekday", "saturday").
+func isDayType(day string) bool {
+  _, isType := dayTypes[strings.ToLower(day)]
+  _, dErr := time.Parse("20060102", day)
+  return isType || dErr == nil
+}
+
+// ServiceDate returns day as a service date (YYYYMMDD), where day is a
+// date, or a day type (e.g., "weekday"), as its busiest date (most trips,
+// or earliest, if tied) from "service_dates" table.
+func ServiceDate(db *sql.DB, day string) (string, error) {
+  if _, dErr := time.Parse("20060102", day); dErr == nil {
+    return day, nil
+  }
+
+  weekdays, ok := dayTypes[strings.ToLower(day)]
+  if ok == false {
+    return "", fmt.Errorf("invalid day %q, expected YYYYMMDD or day type", day)
+  }
+  if hasDBTable(db, "service_dates") == false {
+    return "", fmt.Errorf("missing service_dates table")
+  }
+
+  rows, qErr := db.Query(`
+    select sd.date, count(t.trip_id) from service_dates sd
+      join trips t on t.service_id = sd.service_id
+    group by sd.date order by sd.date;`)
+  if qErr != nil {
+    return "", fmt.Errorf("failed to query service_dates [%s]", qErr)
+  }
+  defer rows.Close()
+
+  busiest, most := "", 0
+  for rows.Next() {
+    var date string
+    var n int
+    if sErr := rows.Scan(&date, &n); sErr != nil {
+      return "", fmt.Errorf("failed to scan service_dates [%s]", sErr)
+    }
+
+    d, dErr := time.Parse("20060102", date)
+    if dErr != nil || n <= most {
+      continue
+    }
+    for _, wd := range weekdays {
+      if d.Weekday() == wd {
+        busiest, most = date, n
+      }
+    }
+  }
+
+  if busiest == "" {
+    return "", fmt.Errorf("no service on any %s", day)
+  }
+  return busiest, nil
+}
+
+// Headways returns headways of every route/direction at every stop, on day
+// (a service date, or day type, see ServiceDate), for the whole day
+// ("all_day"), and for each time-of-day period ("name=start-end,...",
+// with hours, e.g., "am=7-9,pm=16:30-18:30").
+func Headways(db *sql.DB, day, periods string) ([]Headway, error) {
+  pds, pErr := parsePeriods(periods)
+  if pErr != nil {
+    return nil, fmt.Errorf("parsePeriods() %s", pErr)
+  }
+
+  if hasDBTable(db, "service_dates") == false {
+    return nil, fmt.Errorf("missing service_dates table")
+  }
+  date, dErr := ServiceDate(db, day)
+  if dErr != nil {
+    return nil, fmt.Errorf("ServiceDate() %s", dErr)
+  }
+
+  // departures of each trip (each frequency-based run, if expanded)
+  stopTimes, tripJoin := "stop_times", "t.trip_id = st.trip_id"
+  if hasDBTable(db, "stop_times_expanded") {
+    stopTimes, tripJoin = "stop_times_expanded",
+      "t.trip_id = st.template_trip_id"
+  }
+  dir := optDBTableCol(db, "t", "trips", "direction_id")
+
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select t.route_id, %s, st.stop_id,
+      coalesce(st.departure_secs, st.arrival_secs) as secs
+    from %s st join trips t on %s
+    where t.service_id in
+        (select service_id from service_dates where date = ?)
+      and coalesce(st.departure_secs, st.arrival_secs) is not null
+    order by t.route_id, 2, st.stop_id, secs;`, dir, stopTimes, tripJoin),
+    date)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to query stop_times [%s]", qErr)
+  }
+
+  // collect departures, of each route/direction/stop
+  var keys [][3]string
+  departures := map[[3]string][]int{}
+  for rows.Next() {
+    var k [3]string
+    var secs int
+    if sErr := rows.Scan(&k[0], &k[1], &k[2], &secs); sErr != nil {
+      rows.Close()
+      return nil, fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+    if _, ok := departures[k]; ok == false {
+      keys = append(keys, k)
+    }
+    departures[k] = append(departures[k], secs)
+  }
+  rows.Close()
+
+  var headways []Headway
+  for _, k := range keys {
+    deps := departures[k]
+    sort.Ints(deps)
+
+    // whole day, and each period
+    byPeriod := map[string][]int{"all_day": deps}
+    names := []string{"all_day"}
+    for _, p := range pds {
+      names = append(names, p.name)
+    }
+    for _, d := range deps {
+      if name := periodOf(pds, d); name != "" {
+        byPeriod[name] = append(byPeriod[name], d)
+      }
+    }
+
+    for _, name := range names {
+      ds := byPeriod[name]
+      if len(ds) == 0 {
+        continue
+      }
+
+      h := Headway{Date: date, RouteID: k[0], DirectionID: k[1],
+        StopID: k[2], Period: name, NumTrips: len(ds),
+        FirstDeparture: ds[0], LastDeparture: ds[len(ds)-1]}
+      for i := 1; i < len(ds); i++ {
+        gap := ds[i] - ds[i-1]
+        if i == 1 || gap < h.MinHeadway {
+          h.MinHeadway = gap
+        }
+        if gap > h.MaxHeadway {
+          h.MaxHeadway = gap
+        }
+      }
+      if len(ds) > 1 {
+        h.AvgHeadway = float64(ds[len(ds)-1] - ds[0]) / float64(len(ds) - 1)
+      }
+      headways = append(headways, h)
+    }
+  }
+
+  return headways, nil
+}
+
+// buildHeadways creates "headways" table (see Headways), on day (service
+// date, or day type), for the whole day and each time-of-day period.
+func buildHeadways(db *sql.DB, day, periods string) error {
+  headways, hErr := Headways(db, day, periods)
+  if hErr != nil {
+    return fmt.Errorf("Headways() %s", hErr)
+  }
+
+  // (re)create "headways" table
+  if _, cErr := db.Exec(`
+    drop table if exists headways;
+    create table headways (date text, route_id text, direction_id text,
+      stop_id text, period text, num_trips integer,
+      min_headway_secs integer, avg_headway_secs real,
+      max_headway_secs integer, first_departure text, last_departure text);`);
+    cErr != nil {
+    return fmt.Errorf("failed to create table `headways` [%s]", cErr)
+  }
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for _, h := range headways {
+    var minH, avgH, maxH interface{} // null, if less than 2 trips
+    if h.NumTrips > 1 {
+      minH, avgH, maxH = h.MinHeadway, h.AvgHeadway, h.MaxHeadway
+    }
+
+    if _, iErr := tx.Exec("insert into headways values " +
+      "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", h.Date, h.RouteID,
+      h.DirectionID, h.StopID, h.Period, h.NumTrips, minH, avgH, maxH,
+      FormatClock(h.FirstDeparture), FormatClock(h.LastDeparture));
+      iErr != nil {
+      return fmt.Errorf("failed to insert into `headways` [%s]", iErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  if _, ciErr := db.Exec(`
+    create index headways_idx on headways (route_id, direction_id, stop_id);
+    create index headways_stop_idx on headways (stop_id);`); ciErr != nil {
+    return fmt.Errorf("failed add index(es) to headways [%s]", ciErr)
+  }
+
+  return nil
+}
@@ -0,0 +1,224 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "database/sql"
+)
+
+// interpStopTime Type Helper: "stop_times" row, for interpolation.
+type interpStopTime struct {
+  rowid     int64
+  tripID    string
+  arrival   sql.NullInt64
+  departure sql.NullInt64
+  arrText   string // arrival_time (kept, if not blank, e.g., invalid)
+  depText   string // departure_time
+  shapeDist sql.NullString
+  lat, lon  sql.NullFloat64
+  flag      int    // "interpolated" value
+}
+
+// interpolateStopTimes fills missing "stop_times" arrival/departure
+// times (e.g., non-timepoint stops), proportionally by distance between
+// the surrounding timed stops, and marks them as "interpolated" = 1.
+// A single missing time of a timed stop is copied from its other time,
+// and marked as "interpolated" = 2.
+// note: only blank times are filled (invalid times are kept as-is).
+// note: distance uses "shape_dist_traveled", when present (and in order)
+//       for all stops between timed stops, otherwise straight-line
+//       distance along stops.
+func interpolateStopTimes(db *sql.DB) error {
+
+  // sanity check for derived "seconds" columns
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return rErr
+  }
+
+  // ensure "interpolated" flag column
+  if hasDBTableCol(db, "stop_times", "interpolated") == false {
+    if _, aErr := db.Exec(
+      "alter table stop_times add column interpolated integer default 0;");
+      aErr != nil {
+      return fmt.Errorf("failed to add `interpolated` column [%s]", aErr)
+    }
+  }
+
+  shapeDist := "null"
+  if hasDBTableCol(db, "stop_times", "shape_dist_traveled") {
+    shapeDist = "st.shape_dist_traveled"
+  }
+
+  // retrieve all stop_times of trips with any missing times
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select st.rowid, st.trip_id, st.arrival_secs, st.departure_secs,
+      coalesce(st.arrival_time, ''), coalesce(st.departure_time, ''), %s,
+      cast(s.stop_lat as real), cast(s.stop_lon as real)
+    from stop_times st left join stops s on st.stop_id = s.stop_id
+    where st.trip_id in (select trip_id from stop_times
+      where arrival_secs is null or departure_secs is null)
+    order by st.trip_id, cast(st.stop_sequence as int);`, shapeDist))
+  if qErr != nil {
+    return fmt.Errorf("failed to query stop_times [%s]", qErr)
+  }
+
+  var trips [][]interpStopTime
+  for rows.Next() {
+    var st interpStopTime
+    if sErr := rows.Scan(&st.rowid, &st.tripID, &st.arrival,
+      &st.departure, &st.arrText, &st.depText, &st.shapeDist, &st.lat,
+      &st.lon); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    // group by trip
+    if n := len(trips); n == 0 || trips[n-1][0].tripID != st.tripID {
+      trips = append(trips, nil)
+    }
+    trips[len(trips)-1] = append(trips[len(trips)-1], st)
+  }
+  rows.Close()
+
+  // interpolate each trip, and collect updated rows
+  var updates []interpStopTime
+  for _, trip := range trips {
+    updates = append(updates, interpolateTrip(trip)...)
+  }
+
+  // write updated rows
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  stmt, pErr := tx.Prepare(`
+    update stop_times set arrival_secs = ?, departure_secs = ?,
+      arrival_time = ?, departure_time = ?, interpolated = ?
+    where rowid = ?;`)
+  if pErr != nil {
+    return fmt.Errorf("failed to prepare update [%s]", pErr)
+  }
+  defer stmt.Close()
+
+  for _, st := range updates {
+    if _, uErr := stmt.Exec(st.arrival, st.departure, st.arrText,
+      st.depText, st.flag, st.rowid); uErr != nil {
+      return fmt.Errorf("failed to update stop_times [%s]", uErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  return nil
+}
+
+// interpolateTrip Helper: Interpolate missing times of a single trip
+// (ordered by stop_sequence), and return only the updated rows.
+// note: stops before the first (or after the last) timed stop are
+//       left as-is, since there is nothing to interpolate between.
+func interpolateTrip(trip []interpStopTime) []interpStopTime {
+
+  // cumulative straight-line distance along stops
+  lineDist := make([]float64, len(trip))
+  for i := 1; i < len(trip); i++ {
+    lineDist[i] = lineDist[i-1]
+    a, b := trip[i-1], trip[i]
+    if a.lat.Valid && a.lon.Valid && b.lat.Valid && b.lon.Valid {
+      lineDist[i] += haversine(a.lat.Float64, a.lon.Float64,
+        b.lat.Float64, b.lon.Float64)
+    }
+  }
+
+  // parsed shape_dist_traveled (NaN, if missing)
+  shapeDist := make([]float64, len(trip))
+  for i, st := range trip {
+    shapeDist[i] = math.NaN()
+    if d, pErr := strconv.ParseFloat(st.shapeDist.String, 64);
+      st.shapeDist.Valid && pErr == nil {
+      shapeDist[i] = d
+    }
+  }
+
+  // fill Helper: Fill blank times of a stop, flagged
+  fill := func(st *interpStopTime, arr, dep int64, flag int) bool {
+    filled := false
+    if st.arrival.Valid == false && st.arrText == "" {
+      st.arrival = sql.NullInt64{Int64: arr, Valid: true}
+      st.arrText = FormatClock(int(arr))
+      filled = true
+    }
+    if st.departure.Valid == false && st.depText == "" {
+      st.departure = sql.NullInt64{Int64: dep, Valid: true}
+      st.depText = FormatClock(int(dep))
+      filled = true
+    }
+    if filled {
+      st.flag = flag
+    }
+    return filled
+  }
+
+  var updates []interpStopTime
+  prev := -1 // index of previous timed stop
+  for i, st := range trip {
+    if st.arrival.Valid == false && st.departure.Valid == false {
+      continue // not timed
+    }
+
+    // fill a single missing time, from the other
+    arr, dep := st.arrival, st.departure
+    if arr.Valid == false {
+      arr = dep
+    }
+    if dep.Valid == false {
+      dep = arr
+    }
+    if fill(&st, arr.Int64, dep.Int64, 2) {
+      trip[i] = st
+      updates = append(updates, st)
+    }
+
+    // interpolate all untimed stops since previous timed stop
+    if prev >= 0 && i-prev > 1 {
+      from := trip[prev].departure
+      if from.Valid == false {
+        from = trip[prev].arrival
+      }
+      to := arr.Int64
+
+      // prefer shape distance, if present (and in order) for all stops
+      // of the span (never mixed with straight-line distance)
+      dist := shapeDist
+      for k := prev+1; k <= i; k++ {
+        if math.IsNaN(dist[k]) || math.IsNaN(dist[k-1]) ||
+           dist[k] < dist[k-1] {
+          dist = lineDist
+          break
+        }
+      }
+
+      for k := prev+1; k < i; k++ {
+
+        // proportion of distance traveled (or of stops, if no distance)
+        frac := float64(k-prev) / float64(i-prev)
+        if span := dist[i] - dist[prev]; span > 0 {
+          frac = math.Max(0, math.Min(1, (dist[k] - dist[prev]) / span))
+        }
+
+        secs := from.Int64 + int64(math.Round(frac * float64(to - from.Int64)))
+        if fill(&trip[k], secs, secs, 1) {
+          updates = append(updates, trip[k])
+        }
+      }
+    }
+
+    prev = i
+  }
+
+  return updates
+}
@@ -0,0 +1,91 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "database/sql"
+)
+
+// interpTestStop Helper: "stop_times" row, for interpolation tests
+// (secs < 0 is missing, text is kept only if secs is missing).
+func interpTestStop(arr, dep int64, arrText, depText, dist string,
+  lat float64) interpStopTime {
+  st := interpStopTime{arrText: arrText, depText: depText,
+    lat: sql.NullFloat64{Float64: lat, Valid: true},
+    lon: sql.NullFloat64{Float64: -74, Valid: true}}
+  if arr >= 0 {
+    st.arrival = sql.NullInt64{Int64: arr, Valid: true}
+    st.arrText = FormatClock(int(arr))
+  }
+  if dep >= 0 {
+    st.departure = sql.NullInt64{Int64: dep, Valid: true}
+    st.depText = FormatClock(int(dep))
+  }
+  if dist != "" {
+    st.shapeDist = sql.NullString{String: dist, Valid: true}
+  }
+  return st
+}
+
+func TestInterpolateTrip(t *testing.T) {
+  tests := []struct {
+    name  string
+    trip  []interpStopTime
+    want  []string // arrival, departure, flag, of each stop
+  }{
+    {
+      name: "by shape distance",
+      trip: []interpStopTime{
+        interpTestStop(28800, 28800, "", "", "0", 40.70),
+        interpTestStop(-1, -1, "", "", "100", 40.75),
+        interpTestStop(29400, 29400, "", "", "400", 40.71),
+      },
+      want: []string{"08:00:00 08:00:00 0", "08:02:30 08:02:30 1",
+        "08:10:00 08:10:00 0"},
+    },
+    {
+      name: "missing shape distance uses straight-line for whole span",
+      trip: []interpStopTime{
+        interpTestStop(28800, 28800, "", "", "0", 40.70),
+        interpTestStop(-1, -1, "", "", "", 40.705),
+        interpTestStop(-1, -1, "", "", "390", 40.709),
+        interpTestStop(29400, 29400, "", "", "400", 40.71),
+      },
+      want: []string{"08:00:00 08:00:00 0", "08:05:00 08:05:00 1",
+        "08:09:00 08:09:00 1", "08:10:00 08:10:00 0"},
+    },
+    {
+      name: "single missing time is copied",
+      trip: []interpStopTime{
+        interpTestStop(28800, -1, "", "", "", 40.70),
+        interpTestStop(-1, 29400, "", "", "", 40.71),
+      },
+      want: []string{"08:00:00 08:00:00 2", "08:10:00 08:10:00 2"},
+    },
+    {
+      name: "invalid times are kept",
+      trip: []interpStopTime{
+        interpTestStop(28800, 28800, "", "", "", 40.70),
+        interpTestStop(-1, -1, "8:0x:00", "", "", 40.705),
+        interpTestStop(-1, 29400, "9:2x:00", "", "", 40.71),
+      },
+      want: []string{"08:00:00 08:00:00 0", "8:0x:00 08:05:00 1",
+        "9:2x:00 08:10:00 0"},
+    },
+  }
+
+  for _, tc := range tests {
+    t.Run(tc.name, func(t *testing.T) {
+      interpolateTrip(tc.trip)
+      var got []string
+      for _, st := range tc.trip {
+        got = append(got, fmt.Sprintf("%s %s %d", st.arrText, st.depText,
+          st.flag))
+      }
+      if reflect.DeepEqual(got, tc.want) == false {
+        t.Errorf("stop times = %q, want %q", got, tc.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,296 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "sort"
+  "database/sql"
+)
+
+// isochroneCell: grid cell size (in meters), of isochrone polygons
+const isochroneCell = 50.0
+
+// ReachableStop is a stop reachable from an origin (see Isochrone).
+type ReachableStop struct {
+  StopID    string
+  Name      string
+  Lat, Lon  float64
+  Arrival   int // seconds since midnight (of service date)
+  Duration  int // seconds, since departure
+  Transfers int
+}
+
+// Isochrone loads the timetable of a service date (see LoadTimetable),
+// and returns stops reachable from a place (see Timetable.Reachable).
+func Isochrone(db *sql.DB, from Place, date string, departure,
+  maxDuration int, popt PlanOptions) ([]ReachableStop, error) {
+  tt, tErr := LoadTimetable(db, date)
+  if tErr != nil {
+    return nil, fmt.Errorf("LoadTimetable() %s", tErr)
+  }
+  return tt.Reachable(from, departure, maxDuration, popt)
+}
+
+// Reachable returns stops (with coordinates) reachable from a place,
+// departing at (or after)
+// departure (seconds since midnight), within maxDuration (in seconds),
+// by earliest arrival (over trips, and walking transfers), using RAPTOR.
+func (tt *Timetable) Reachable(from Place, departure, maxDuration int,
+  popt PlanOptions) ([]ReachableStop, error) {
+  if popt.WalkSpeed <= 0 {
+    return nil, fmt.Errorf("invalid walk speed")
+  }
+
+  access, aErr := tt.placeStops(from, popt)
+  if aErr != nil {
+    return nil, fmt.Errorf("invalid origin, %s", aErr)
+  }
+  for s, secs := range access {
+    access[s] = departure + secs
+  }
+
+  // earliest arrivals, of last round (labels are kept in later rounds)
+  labels := tt.raptor(access, popt.MaxTransfers + 1, popt.WalkSpeed, nil)
+  last := labels[len(labels)-1]
+
+  var stops []ReachableStop
+  for i, l := range last {
+    s := tt.stops[i]
+    if l.arr == raptorInf || l.arr - departure > maxDuration ||
+      s.located == false {
+      continue
+    }
+    rs := ReachableStop{StopID: s.id, Name: s.name, Lat: s.lat, Lon: s.lon,
+      Arrival: l.arr, Duration: l.arr - departure}
+    if l.round > 1 {
+      rs.Transfers = l.round - 1
+    }
+    stops = append(stops, rs)
+  }
+
+  sort.Slice(stops, func(i, j int) bool {
+    return stops[i].Arrival < stops[j].Arrival ||
+      (stops[i].Arrival == stops[j].Arrival && stops[i].StopID < stops[j].StopID)
+  })
+  return stops, nil
+}
+
+// IsochroneGeoJSON returns reachable stops (Points), and a MultiPolygon of
+// each time band (in minutes, largest first), as a GeoJSON
+// FeatureCollection. Polygons are the union of walkable circles around
+// each stop reached within the band (walking the time left, up to max
+// walk), rasterized on a grid.
+func IsochroneGeoJSON(stops []ReachableStop, bands []int,
+  popt PlanOptions) map[string]interface{} {
+  features := []jsony{}
+
+  sorted := append([]int(nil), bands...)
+  sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+  for _, band := range sorted {
+    polygons := isochronePolygons(stops, band * 60, popt)
+    if len(polygons) == 0 {
+      continue
+    }
+    features = append(features, jsony{
+      "type": "Feature",
+      "properties": jsony{
+        "band_minutes": band,
+      },
+      "geometry": jsony{
+        "type": "MultiPolygon",
+        "coordinates": polygons,
+      },
+    })
+  }
+
+  for _, s := range stops {
+    features = append(features, jsony{
+      "type": "Feature",
+      "properties": jsony{
+        "stop_id":       s.StopID,
+        "stop_name":     s.Name,
+        "arrival":       FormatClock(s.Arrival),
+        "duration_secs": s.Duration,
+        "transfers":     s.Transfers,
+      },
+      "geometry": jsony{
+        "type": "Point",
+        "coordinates": [2]float64{s.Lon, s.Lat},
+      },
+    })
+  }
+
+  return map[string]interface{}{
+    "type": "FeatureCollection",
+    "features": features,
+  }
+}
+
+// isochronePolygons Helper: Polygons (as [lon, lat] rings, outer ring
+// counterclockwise, then its holes) of the union of walkable circles
+// around stops reached within band (in seconds).
+func isochronePolygons(stops []ReachableStop, band int,
+  popt PlanOptions) [][][][2]float64 {
+  if len(stops) == 0 {
+    return nil
+  }
+
+  // local planar grid (in cells), around first stop
+  lat0, lon0 := stops[0].Lat, stops[0].Lon
+  ky := earthRadius * math.Pi / 180 / isochroneCell
+  kx := ky * math.Cos(lat0 * math.Pi / 180)
+
+  // fill cells (by center) within each stop's circle
+  filled := map[[2]int]bool{}
+  for _, s := range stops {
+    if s.Duration > band {
+      continue
+    }
+    r := math.Min(float64(band - s.Duration) * popt.WalkSpeed, popt.MaxWalk)
+    r /= isochroneCell
+    cx, cy := (s.Lon - lon0) * kx, (s.Lat - lat0) * ky
+    for x := int(math.Floor(cx - r)); x <= int(math.Ceil(cx + r)); x++ {
+      for y := int(math.Floor(cy - r)); y <= int(math.Ceil(cy + r)); y++ {
+        if math.Hypot(float64(x) + 0.5 - cx, float64(y) + 0.5 - cy) <= r {
+          filled[[2]int{x, y}] = true
+        }
+      }
+    }
+  }
+
+  // boundary edges (directed, with filled cell on the left)
+  edges := map[[2]int][][2]int{} // vertex, to next vertices
+  addEdge := func(a, b [2]int) {
+    edges[a] = append(edges[a], b)
+  }
+  cells := make([][2]int, 0, len(filled))
+  for c := range filled {
+    cells = append(cells, c)
+  }
+  sort.Slice(cells, func(i, j int) bool { // deterministic
+    return cells[i][1] < cells[j][1] ||
+      (cells[i][1] == cells[j][1] && cells[i][0] < cells[j][0])
+  })
+  for _, c := range cells {
+    x, y := c[0], c[1]
+    if filled[[2]int{x, y - 1}] == false {
+      addEdge([2]int{x, y}, [2]int{x + 1, y})
+    }
+    if filled[[2]int{x + 1, y}] == false {
+      addEdge([2]int{x + 1, y}, [2]int{x + 1, y + 1})
+    }
+    if filled[[2]int{x, y + 1}] == false {
+      addEdge([2]int{x + 1, y + 1}, [2]int{x, y + 1})
+    }
+    if filled[[2]int{x - 1, y}] == false {
+      addEdge([2]int{x, y + 1}, [2]int{x, y})
+    }
+  }
+
+  // chain edges into rings (turning left first, at touching corners)
+  var rings [][][2]int
+  for _, start := range cells {
+    for len(edges[start]) > 0 {
+      ring := [][2]int{start}
+      prev, cur := start, edges[start][0]
+      edges[start] = edges[start][1:]
+      for cur != start {
+        ring = append(ring, cur)
+        next := edges[cur]
+        d := [2]int{cur[0] - prev[0], cur[1] - prev[1]}
+        pick := 0
+        for _, turn := range [...][2]int{{-d[1], d[0]}, d, {d[1], -d[0]}} {
+          found := false
+          for i, n := range next {
+            if n[0] - cur[0] == turn[0] && n[1] - cur[1] == turn[1] {
+              pick, found = i, true
+              break
+            }
+          }
+          if found {
+            break
+          }
+        }
+        prev, cur = cur, next[pick]
+        edges[prev] = append(next[:pick:pick], next[pick+1:]...)
+      }
+      rings = append(rings, simplifyRing(ring))
+    }
+  }
+
+  // outer rings (counterclockwise), and holes (clockwise) within them
+  toLonLat := func(ring [][2]int) [][2]float64 {
+    coords := make([][2]float64, 0, len(ring) + 1)
+    for _, v := range append(ring, ring[0]) {
+      coords = append(coords, [2]float64{
+        lon0 + float64(v[0]) / kx, lat0 + float64(v[1]) / ky})
+    }
+    return coords
+  }
+  var outers, holes [][][2]int
+  for _, ring := range rings {
+    if ringArea(ring) > 0 {
+      outers = append(outers, ring)
+    } else {
+      holes = append(holes, ring)
+    }
+  }
+
+  polygons := make([][][][2]float64, len(outers))
+  for i, outer := range outers {
+    polygons[i] = [][][2]float64{toLonLat(outer)}
+  }
+  for _, hole := range holes {
+    for i, outer := range outers {
+      if ringContains(outer, hole[0]) {
+        polygons[i] = append(polygons[i], toLonLat(hole))
+        break
+      }
+    }
+  }
+
+  return polygons
+}
+
+// simplifyRing Helper: Remove collinear vertices of a grid ring.
+func simplifyRing(ring [][2]int) [][2]int {
+  var simple [][2]int
+  n := len(ring)
+  for i, v := range ring {
+    a, b := ring[(i + n - 1) % n], ring[(i + 1) % n]
+    if (v[0] - a[0]) * (b[1] - v[1]) != (v[1] - a[1]) * (b[0] - v[0]) {
+      simple = append(simple, v)
+    }
+  }
+  return simple
+}
+
+// ringArea Helper: Signed area of a ring (positive, if counterclockwise).
+func ringArea(ring [][2]int) int {
+  area := 0
+  for i, v := range ring {
+    w := ring[(i + 1) % len(ring)]
+    area += v[0] * w[1] - w[0] * v[1]
+  }
+  return area
+}
+
+// ringContains Helper: Check if a point (vertex of another ring, never on
+// this ring's edges, except at corners) is within a ring.
+func ringContains(ring [][2]int, p [2]int) bool {
+
+  // ray casting (from cell center, next to vertex)
+  px, py := float64(p[0]) + 0.5, float64(p[1]) + 0.5
+  inside := false
+  for i, v := range ring {
+    w := ring[(i + 1) % len(ring)]
+    vy, wy := float64(v[1]), float64(w[1])
+    if (vy > py) != (wy > py) {
+      x := float64(v[0]) + (py - vy) / (wy - vy) * float64(w[0] - v[0])
+      if px < x {
+        inside = !inside
+      }
+    }
+  }
+  return inside
+}
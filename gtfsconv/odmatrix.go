@@ -0,0 +1,231 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "os"
+  "sort"
+  "strconv"
+  "sync"
+  "encoding/csv"
+  "database/sql"
+)
+
+// ODPair is the minimum travel time from a stop to another (see ODMatrix).
+type ODPair struct {
+  FromStopID  string
+  ToStopID    string
+  Departure   int // best departure (seconds since midnight)
+  TravelTime  int // in seconds
+  Transfers   int
+}
+
+// ODOptions are the options of an origin-destination matrix (see ODMatrix).
+type ODOptions struct {
+  Plan          PlanOptions
+  Start, End    int      // departure window (seconds since midnight)
+  MaxTravelTime int      // in seconds (0 = no max)
+  Stops         []string // origins, and destinations (empty = all served)
+  Workers       int      // max parallel workers
+}
+
+// ODMatrix loads the timetable of a service date (see LoadTimetable), and
+// returns its origin-destination matrix (see Timetable.ODMatrix).
+func ODMatrix(db *sql.DB, date string, oopt ODOptions) ([]ODPair, error) {
+  tt, tErr := LoadTimetable(db, date)
+  if tErr != nil {
+    return nil, fmt.Errorf("LoadTimetable() %s", tErr)
+  }
+  return tt.ODMatrix(oopt)
+}
+
+// ODMatrix returns the minimum scheduled travel time between each pair of
+// stops (each stop served by a trip, or oopt.Stops), departing within the
+// departure window, using RAPTOR from each departure of each origin (and
+// walking transfers from it), with origins split across parallel workers.
+func (tt *Timetable) ODMatrix(oopt ODOptions) ([]ODPair, error) {
+  if oopt.Plan.WalkSpeed <= 0 {
+    return nil, fmt.Errorf("invalid walk speed")
+  }
+  if oopt.End < oopt.Start {
+    return nil, fmt.Errorf("invalid departure window, end before start")
+  }
+
+  // origins, and destinations (each once)
+  var stops []int
+  seen := map[int]bool{}
+  for _, id := range oopt.Stops {
+    s, ok := tt.stopIdx[id]
+    if ok == false {
+      return nil, fmt.Errorf("unknown stop %q", id)
+    }
+    if seen[s] == false {
+      seen[s] = true
+      stops = append(stops, s)
+    }
+  }
+  if len(oopt.Stops) == 0 {
+    for s := range tt.stops {
+      if len(tt.stopRoutes[s]) > 0 {
+        stops = append(stops, s)
+      }
+    }
+  }
+
+  workers := oopt.Workers
+  if workers < 1 {
+    workers = 1
+  }
+
+  // travel times from each origin (in parallel)
+  results := make([][]ODPair, len(stops))
+  jobs := make(chan int)
+  var wg sync.WaitGroup
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := range jobs {
+        results[i] = tt.odFrom(stops[i], stops, oopt)
+      }
+    }()
+  }
+  for i := range stops {
+    jobs <- i
+  }
+  close(jobs)
+  wg.Wait()
+
+  var pairs []ODPair
+  for _, r := range results {
+    pairs = append(pairs, r...)
+  }
+  return pairs, nil
+}
+
+// odFrom Helper: Minimum travel times from origin to destinations, by
+// range RAPTOR (departures latest first, keeping labels across them).
+func (tt *Timetable) odFrom(origin int, dests []int,
+  oopt ODOptions) []ODPair {
+
+  // departures within window, of trips at origin (or walking to them)
+  times := map[int]bool{oopt.Start: true}
+  addTimes := func(s, walk int) {
+    for _, rp := range tt.stopRoutes[s] {
+      for _, t := range tt.routes[rp[0]].trips {
+        dep := t.dep[rp[1]] - walk
+        if dep >= oopt.Start && dep <= oopt.End && t.noBoard[rp[1]] == false {
+          times[dep] = true
+        }
+      }
+    }
+  }
+  addTimes(origin, 0)
+  for _, fp := range tt.footpaths[origin] {
+    addTimes(fp.to, fp.walkSecs(oopt.Plan.WalkSpeed))
+  }
+  departures := make([]int, 0, len(times))
+  for t := range times {
+    departures = append(departures, t)
+  }
+  sort.Sort(sort.Reverse(sort.IntSlice(departures)))
+
+  // best travel time, of each departure (arrivals of later departures
+  // are kept, but never improve travel time of earlier ones)
+  run := tt.newRaptorRun(oopt.Plan.MaxTransfers + 1)
+  last := run.labels[len(run.labels)-1]
+  best := make([]ODPair, len(dests))
+  for _, dep := range departures {
+    bound := raptorInf
+    if oopt.MaxTravelTime > 0 {
+      bound = dep + oopt.MaxTravelTime
+    }
+    tt.raptorRange(run, map[int]int{origin: dep}, oopt.Plan.WalkSpeed, nil,
+      bound)
+
+    for i, d := range dests {
+      l := last[d]
+      if d == origin || l.arr > bound {
+        continue
+      }
+      travel := l.arr - dep
+      if best[i].ToStopID != "" && best[i].TravelTime <= travel {
+        continue
+      }
+
+      best[i] = ODPair{FromStopID: tt.stops[origin].id,
+        ToStopID: tt.stops[d].id, Departure: dep, TravelTime: travel}
+      if l.round > 1 {
+        best[i].Transfers = l.round - 1
+      }
+    }
+  }
+
+  var pairs []ODPair
+  for _, p := range best {
+    if p.ToStopID != "" {
+      pairs = append(pairs, p)
+    }
+  }
+  return pairs
+}
+
+// WriteODMatrix (re)creates "od_matrix" table, with pairs (see ODMatrix),
+// in a single transaction (keeping the previous table, if failed).
+func WriteODMatrix(db *sql.DB, pairs []ODPair) error {
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  if _, cErr := tx.Exec(`
+    drop table if exists od_matrix;
+    create table od_matrix (from_stop_id text, to_stop_id text,
+      departure_time text, travel_secs integer, transfers integer);`);
+    cErr != nil {
+    return fmt.Errorf("failed to create table `od_matrix` [%s]", cErr)
+  }
+
+  for _, p := range pairs {
+    if _, iErr := tx.Exec("insert into od_matrix values (?, ?, ?, ?, ?);",
+      p.FromStopID, p.ToStopID, FormatClock(p.Departure), p.TravelTime,
+      p.Transfers); iErr != nil {
+      return fmt.Errorf("failed to insert into `od_matrix` [%s]", iErr)
+    }
+  }
+
+  if _, ciErr := tx.Exec(`
+    create unique index od_matrix_idx on od_matrix (from_stop_id, to_stop_id);
+    create index od_matrix_to_idx on od_matrix (to_stop_id);`);
+    ciErr != nil {
+    return fmt.Errorf("failed add index(es) to od_matrix [%s]", ciErr)
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+  return nil
+}
+
+// WriteODMatrixCSV writes pairs (see ODMatrix) into a csv file.
+func WriteODMatrixCSV(name string, pairs []ODPair) error {
+  f, cErr := os.Create(name)
+  if cErr != nil {
+    return fmt.Errorf("failed to create csv file [%s]", cErr)
+  }
+  defer f.Close()
+
+  w := csv.NewWriter(f)
+  w.Write([]string{"from_stop_id", "to_stop_id", "departure_time",
+    "travel_secs", "transfers"})
+  for _, p := range pairs {
+    w.Write([]string{p.FromStopID, p.ToStopID, FormatClock(p.Departure),
+      strconv.Itoa(p.TravelTime), strconv.Itoa(p.Transfers)})
+  }
+  w.Flush()
+
+  if wErr := w.Error(); wErr != nil {
+    return fmt.Errorf("failed to write csv file [%s]", wErr)
+  }
+  return f.Close()
+}
@@ -0,0 +1,257 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "database/sql"
+)
+
+// tripPattern Type Helper: trips with the same route, direction,
+// shape, and exact ordered stops (see buildPatterns).
+type tripPattern struct {
+  id          string
+  routeID     string
+  directionID string
+  shapeID     string
+  name        string // origin → destination
+  stops       []string
+  trips       []string
+  numTrips    int // including each frequency-based run (if expanded)
+  isPrimary   bool
+}
+
+// buildPatterns creates "patterns" (trips grouped by route, direction,
+// shape, and exact ordered stop sequence), with "pattern_stops",
+// "pattern_trips", names (origin → destination), trip counts, and the
+// primary (most trips) pattern of each route/direction.
+func buildPatterns(db *sql.DB) error {
+
+  // (re)create pattern tables
+  if _, cErr := db.Exec(`
+    drop table if exists patterns;
+    create table patterns (pattern_id text, route_id text,
+      direction_id text, shape_id text, name text,
+      origin_stop_id text, destination_stop_id text,
+      num_stops integer, num_trips integer, is_primary integer default 0);
+
+    drop table if exists pattern_stops;
+    create table pattern_stops (pattern_id text, stop_sequence integer,
+      stop_id text);
+
+    drop table if exists pattern_trips;
+    create table pattern_trips (pattern_id text, trip_id text);`);
+    cErr != nil {
+    return fmt.Errorf("failed to create pattern tables [%s]", cErr)
+  }
+
+  // number of runs of each trip (frequency-based trips, if expanded)
+  runs := map[string]int{}
+  if hasDBTable(db, "trip_instances") {
+    rows, qErr := db.Query("select template_trip_id, count(*) " +
+      "from trip_instances group by template_trip_id;")
+    if qErr != nil {
+      return fmt.Errorf("failed to query trip_instances [%s]", qErr)
+    }
+    for rows.Next() {
+      var id string
+      var n int
+      if sErr := rows.Scan(&id, &n); sErr != nil {
+        rows.Close()
+        return fmt.Errorf("failed to scan trip_instances [%s]", sErr)
+      }
+      runs[id] = n
+    }
+    rows.Close()
+  }
+
+  // retrieve ordered stops of each trip
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select t.trip_id, t.route_id, %s, %s, st.stop_id
+    from trips t join stop_times st on st.trip_id = t.trip_id
+    order by t.trip_id, cast(st.stop_sequence as int);`,
+    optDBTableCol(db, "t", "trips", "direction_id"),
+    optDBTableCol(db, "t", "trips", "shape_id")))
+  if qErr != nil {
+    return fmt.Errorf("failed to query stop_times [%s]", qErr)
+  }
+
+  // group trips by pattern
+  var patterns []*tripPattern
+  byKey := map[string]*tripPattern{}
+  var trip *tripPattern // current trip (as its own pattern)
+  addTrip := func() {
+    if trip == nil {
+      return
+    }
+    key := strings.Join(append([]string{trip.routeID, trip.directionID,
+      trip.shapeID}, trip.stops...), "\x00")
+    p, ok := byKey[key]
+    if ok == false {
+      p = &tripPattern{routeID: trip.routeID, directionID: trip.directionID,
+        shapeID: trip.shapeID, stops: trip.stops}
+      byKey[key] = p
+      patterns = append(patterns, p)
+    }
+
+    n, ok := runs[trip.trips[0]]
+    if ok == false {
+      n = 1
+    }
+    p.trips = append(p.trips, trip.trips[0])
+    p.numTrips += n
+  }
+
+  for rows.Next() {
+    var tripID, routeID, dirID, shapeID, stopID string
+    if sErr := rows.Scan(&tripID, &routeID, &dirID, &shapeID, &stopID);
+      sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    if trip == nil || trip.trips[0] != tripID { // next trip
+      addTrip()
+      trip = &tripPattern{routeID: routeID, directionID: dirID,
+        shapeID: shapeID, trips: []string{tripID}}
+    }
+    trip.stops = append(trip.stops, stopID)
+  }
+  addTrip()
+  rows.Close()
+
+  // number patterns within each route/direction, by most trips (then
+  // most stops), the first being primary
+  sort.SliceStable(patterns, func(i, j int) bool {
+    a, b := patterns[i], patterns[j]
+    switch {
+      case a.routeID != b.routeID: return a.routeID < b.routeID
+      case a.directionID != b.directionID: return a.directionID < b.directionID
+      case a.numTrips != b.numTrips: return a.numTrips > b.numTrips
+      case len(a.stops) != len(b.stops): return len(a.stops) > len(b.stops)
+      default: return a.trips[0] < b.trips[0]
+    }
+  })
+  n := 0
+  for i, p := range patterns {
+    if i == 0 || patterns[i-1].routeID != p.routeID ||
+      patterns[i-1].directionID != p.directionID {
+      n = 0 // next route/direction
+    }
+    n++
+    p.id = fmt.Sprintf("%s:%s:%d", p.routeID, p.directionID, n)
+    p.isPrimary = n == 1
+  }
+
+  // insert patterns
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for _, p := range patterns {
+    if _, iErr := tx.Exec("insert into patterns (pattern_id, route_id, " +
+      "direction_id, shape_id, origin_stop_id, destination_stop_id, " +
+      "num_stops, num_trips, is_primary) " +
+      "values (?, ?, ?, nullif(?, ''), ?, ?, ?, ?, ?);",
+      p.id, p.routeID, p.directionID, p.shapeID, p.stops[0],
+      p.stops[len(p.stops)-1], len(p.stops), p.numTrips, p.isPrimary);
+      iErr != nil {
+      return fmt.Errorf("failed to insert into `patterns` [%s]", iErr)
+    }
+
+    for i, s := range p.stops {
+      if _, iErr := tx.Exec("insert into pattern_stops " +
+        "(pattern_id, stop_sequence, stop_id) values (?, ?, ?);",
+        p.id, i+1, s); iErr != nil {
+        return fmt.Errorf("failed to insert into `pattern_stops` [%s]", iErr)
+      }
+    }
+
+    for _, t := range p.trips {
+      if _, iErr := tx.Exec("insert into pattern_trips " +
+        "(pattern_id, trip_id) values (?, ?);", p.id, t); iErr != nil {
+        return fmt.Errorf("failed to insert into `pattern_trips` [%s]", iErr)
+      }
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  // name patterns (origin → destination)
+  if _, uErr := db.Exec(`
+    create unique index patterns_idx on patterns (pattern_id);
+    create index patterns_route_idx on patterns (route_id, direction_id);
+    create index pattern_stops_idx on pattern_stops (pattern_id);
+    create index pattern_stops_stop_idx on pattern_stops (stop_id);
+    create unique index pattern_trips_idx on pattern_trips (trip_id);
+    create index pattern_trips_pattern_idx on pattern_trips (pattern_id);
+
+    update patterns set name =
+      coalesce((select stop_name from stops
+        where stop_id = patterns.origin_stop_id), origin_stop_id) ||
+      ' → ' ||
+      coalesce((select stop_name from stops
+        where stop_id = patterns.destination_stop_id), destination_stop_id);`);
+    uErr != nil {
+    return fmt.Errorf("failed to update patterns [%s]", uErr)
+  }
+
+  return nil
+}
+
+// queryPatterns Helper: Retrieve all patterns (with stops, and trips).
+func queryPatterns(db *sql.DB) ([]*tripPattern, error) {
+  rows, qErr := db.Query(`
+    select pattern_id, route_id, direction_id, coalesce(shape_id, ''),
+      name, num_trips, is_primary
+    from patterns order by route_id, direction_id, num_trips desc;`)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select patterns [%s]", qErr)
+  }
+
+  var patterns []*tripPattern
+  byID := map[string]*tripPattern{}
+  for rows.Next() {
+    p := &tripPattern{}
+    if sErr := rows.Scan(&p.id, &p.routeID, &p.directionID, &p.shapeID,
+      &p.name, &p.numTrips, &p.isPrimary); sErr != nil {
+      rows.Close()
+      return nil, fmt.Errorf("failed to scan patterns [%s]", sErr)
+    }
+    patterns = append(patterns, p)
+    byID[p.id] = p
+  }
+  rows.Close()
+
+  // add ordered stops, and trips, of each pattern
+  for i, q := range [...]string{
+    "select pattern_id, stop_id from pattern_stops " +
+      "order by pattern_id, stop_sequence;",
+    "select pattern_id, trip_id from pattern_trips " +
+      "order by pattern_id, trip_id;"} {
+    rows, qErr := db.Query(q)
+    if qErr != nil {
+      return nil, fmt.Errorf("failed to select pattern rows [%s]", qErr)
+    }
+
+    var id, v string
+    for rows.Next() {
+      if sErr := rows.Scan(&id, &v); sErr != nil {
+        rows.Close()
+        return nil, fmt.Errorf("failed to scan pattern rows [%s]", sErr)
+      }
+      if p, ok := byID[id]; ok && i == 0 {
+        p.stops = append(p.stops, v)
+      } else if ok {
+        p.trips = append(p.trips, v)
+      }
+    }
+    rows.Close()
+  }
+
+  return patterns, nil
+}
@@ -0,0 +1,364 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+  "database/sql"
+)
+
+// refShape Type Helper: shape points, for linear referencing.
+type refShape struct {
+  rowids  []int64
+  points  [][2]float64  // [lat, lon]
+  cum     []float64     // cumulative distance (in meters)
+  dist    []float64     // "shape_dist_traveled" (see fillShapeDist)
+  blank   []bool        // if "shape_dist_traveled" is blank (to be filled)
+}
+
+// refStop Type Helper: "stop_times" row, for linear referencing.
+type refStop struct {
+  rowid     int64
+  stopID    string
+  lat, lon  float64
+  dist      float64 // projected "shape_dist_traveled" (in shape units)
+  meters    float64 // projected distance along shape (in meters)
+  offset    float64 // distance from shape (in meters)
+}
+
+// projectStops projects each trip's stops onto its shape, in order (never
+// moving backwards along the shape), and fills blank "shape_dist_traveled"
+// of "shapes" and "stop_times", in the units of the shape's existing
+// values (or meters, for shapes without any, see fillShapeDist). Existing
+// values are never overwritten. Every projected stop gets "shape_offset"
+// (meters from shape), and "off_shape" = 1 when farther than maxOffset
+// (in meters).
+func projectStops(db *sql.DB, maxOffset float64) error {
+
+  // ensure "shape_dist_traveled" columns, and "stop_times" offset columns
+  for _, c := range [...][3]string{
+    {"shapes", "shape_dist_traveled", "text"},
+    {"stop_times", "shape_dist_traveled", "text"},
+    {"stop_times", "shape_offset", "real"},
+    {"stop_times", "off_shape", "integer default 0"}} {
+    if hasDBTableCol(db, c[0], c[1]) == false {
+      if _, aErr := db.Exec(fmt.Sprintf(
+        "alter table %s add column %s %s;", c[0], c[1], c[2])); aErr != nil {
+        return fmt.Errorf("failed to add `%s.%s` column [%s]",
+          c[0], c[1], aErr)
+      }
+    }
+  }
+
+  shapes, sErr := queryRefShapes(db)
+  if sErr != nil {
+    return fmt.Errorf("queryRefShapes() %s", sErr)
+  }
+
+  trips, tErr := queryRefTrips(db)
+  if tErr != nil {
+    return fmt.Errorf("queryRefTrips() %s", tErr)
+  }
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  // fill blank "shapes.shape_dist_traveled" (in shape units)
+  for _, s := range shapes {
+    for i, rowid := range s.rowids {
+      if s.blank[i] == false {
+        continue
+      }
+      if _, uErr := tx.Exec(
+        "update shapes set shape_dist_traveled = ? where rowid = ?;",
+        math.Round(s.dist[i] * 1000) / 1000, rowid); uErr != nil {
+        return fmt.Errorf("failed to update shapes [%s]", uErr)
+      }
+    }
+  }
+
+  // project stops of each trip (once per shape and stop pattern)
+  projected := map[string][]refStop{}
+  for shapeID, stops := range trips {
+    for _, trip := range stops {
+      s, ok := shapes[shapeID]
+      if ok == false || len(trip) == 0 {
+        continue
+      }
+
+      key := shapeID
+      for _, st := range trip {
+        key += "\x00" + st.stopID
+      }
+      if p, ok := projected[key]; ok {
+        for i := range trip {
+          trip[i].dist, trip[i].meters = p[i].dist, p[i].meters
+          trip[i].offset = p[i].offset
+        }
+      } else {
+        projectTrip(s, trip)
+        projected[key] = trip
+      }
+
+      for _, st := range trip {
+        offShape := 0
+        if st.offset > maxOffset {
+          offShape = 1
+        }
+
+        if _, uErr := tx.Exec(`
+          update stop_times set shape_dist_traveled = case
+              when trim(coalesce(shape_dist_traveled, '')) = '' then ?
+              else shape_dist_traveled end,
+            shape_offset = ?, off_shape = ?
+          where rowid = ?;`,
+          math.Round(st.dist * 1000) / 1000,
+          math.Round(st.offset * 10) / 10, offShape, st.rowid);
+          uErr != nil {
+          return fmt.Errorf("failed to update stop_times [%s]", uErr)
+        }
+      }
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  return nil
+}
+
+// projectTrip Helper: Project stops onto shape, in order, minimizing the
+// total distance from shape (dynamic programming over shape segments,
+// where each stop's segment is never before the previous stop's).
+func projectTrip(s *refShape, stops []refStop) {
+  n := len(s.points)
+  numSegs := n - 1
+  if numSegs < 1 {
+    numSegs = 1 // single point shape
+  }
+
+  // local planar coordinates (in meters), around first shape point
+  ky := earthRadius * math.Pi / 180
+  kx := ky * math.Cos(s.points[0][0] * math.Pi / 180)
+  xy := func(lat, lon float64) [2]float64 {
+    return [2]float64{lon * kx, lat * ky}
+  }
+
+  pts := make([][2]float64, n)
+  for i, p := range s.points {
+    pts[i] = xy(p[0], p[1])
+  }
+
+  // for each stop and segment, closest point (as fraction) and offset
+  frac := make([][]float64, len(stops))
+  back := make([][]int, len(stops)) // best previous segment (<= this one)
+  var prevCost []float64
+  for i, st := range stops {
+    p := xy(st.lat, st.lon)
+    frac[i] = make([]float64, numSegs)
+    back[i] = make([]int, numSegs)
+    cost := make([]float64, numSegs)
+
+    bestK, bestCost := 0, math.Inf(1)
+    for j := 0; j < numSegs; j++ {
+      a, b := pts[j], pts[int(math.Min(float64(j+1), float64(n-1)))]
+      t := 0.0
+      dx, dy := b[0] - a[0], b[1] - a[1]
+      if l := dx*dx + dy*dy; l > 0 {
+        t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / l))
+      }
+      frac[i][j] = t
+      cost[j] = math.Hypot(a[0] + t*dx - p[0], a[1] + t*dy - p[1])
+
+      if i > 0 {
+        if prevCost[j] < bestCost {
+          bestK, bestCost = j, prevCost[j]
+        }
+        back[i][j] = bestK
+        cost[j] += bestCost
+      }
+    }
+    prevCost = cost
+  }
+
+  // backtrack, from best segment of last stop
+  segs := make([]int, len(stops))
+  j := 0
+  for k := range prevCost {
+    if prevCost[k] < prevCost[j] {
+      j = k
+    }
+  }
+  for i := len(stops) - 1; i >= 0; i-- {
+    segs[i] = j
+    j = back[i][j]
+  }
+
+  // position along shape, never before previous stop (on same segment)
+  for i := range stops {
+    j, t := segs[i], frac[i][segs[i]]
+    if i > 0 && segs[i-1] == j {
+      t = math.Max(t, frac[i-1][j])
+    }
+    k := int(math.Min(float64(j+1), float64(n-1)))
+
+    a, b := pts[j], pts[k]
+    p := xy(stops[i].lat, stops[i].lon)
+    stops[i].offset = math.Hypot(a[0] + t*(b[0]-a[0]) - p[0],
+      a[1] + t*(b[1]-a[1]) - p[1])
+    stops[i].dist = s.dist[j] + t*(s.dist[k] - s.dist[j])
+    stops[i].meters = s.cum[j] + t*(s.cum[k] - s.cum[j])
+    frac[i][j] = t
+  }
+}
+
+// queryRefShapes Helper: Retrieve all shapes, with cumulative distances,
+// and "shape_dist_traveled" (filled where missing, see fillShapeDist).
+func queryRefShapes(db *sql.DB) (map[string]*refShape, error) {
+  shapeDist := "null"
+  if hasDBTableCol(db, "shapes", "shape_dist_traveled") {
+    shapeDist = "shape_dist_traveled"
+  }
+
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select rowid, shape_id, cast(shape_pt_lat as real),
+      cast(shape_pt_lon as real), %s
+    from shapes order by shape_id, cast(shape_pt_sequence as int);`,
+    shapeDist))
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select shapes [%s]", qErr)
+  }
+  defer rows.Close()
+
+  shapes := map[string]*refShape{}
+  for rows.Next() {
+    var rowid int64
+    var id string
+    var pt [2]float64
+    var dist sql.NullString
+    if sErr := rows.Scan(&rowid, &id, &pt[0], &pt[1], &dist); sErr != nil {
+      return nil, fmt.Errorf("failed to scan shapes [%s]", sErr)
+    }
+
+    s, ok := shapes[id]
+    if ok == false {
+      s = &refShape{}
+      shapes[id] = s
+    }
+
+    // cumulative distance (in meters)
+    cum := 0.0
+    if n := len(s.points); n > 0 {
+      prev := s.points[n-1]
+      cum = s.cum[n-1] + haversine(prev[0], prev[1], pt[0], pt[1])
+    }
+    s.rowids = append(s.rowids, rowid)
+    s.points = append(s.points, pt)
+    s.cum = append(s.cum, cum)
+
+    text := strings.TrimSpace(dist.String)
+    d, pErr := strconv.ParseFloat(text, 64)
+    if pErr != nil {
+      d = math.NaN() // missing (or invalid)
+    }
+    s.dist = append(s.dist, d)
+    s.blank = append(s.blank, text == "")
+  }
+
+  for _, s := range shapes {
+    fillShapeDist(s)
+  }
+
+  return shapes, nil
+}
+
+// fillShapeDist Helper: Fill missing "shape_dist_traveled" (NaN) of a
+// shape, in the units of its existing values: by meters along the shape,
+// scaled between the surrounding known points (or, before the first/after
+// the last known point, by the shape's overall units per meter). Shapes
+// without any known values are filled in meters.
+func fillShapeDist(s *refShape) {
+  var known []int
+  for i, d := range s.dist {
+    if math.IsNaN(d) == false {
+      known = append(known, i)
+    }
+  }
+  if len(known) == 0 {
+    copy(s.dist, s.cum)
+    return
+  }
+
+  // overall units per meter (or meters, if unknown)
+  scale := 1.0
+  if a, b := known[0], known[len(known)-1]; s.cum[b] > s.cum[a] &&
+    s.dist[b] > s.dist[a] {
+    scale = (s.dist[b] - s.dist[a]) / (s.cum[b] - s.cum[a])
+  }
+
+  k := 0 // index (into known) of next known point
+  for i := range s.dist {
+    if k < len(known) && known[k] == i {
+      k++
+      continue
+    }
+
+    switch {
+      case k == 0: // before first known point
+        q := known[0]
+        s.dist[i] = math.Max(0, s.dist[q] - (s.cum[q] - s.cum[i]) * scale)
+      case k == len(known): // after last known point
+        p := known[k-1]
+        s.dist[i] = s.dist[p] + (s.cum[i] - s.cum[p]) * scale
+      default:
+        p, q := known[k-1], known[k]
+        s.dist[i] = s.dist[p]
+        if span := s.cum[q] - s.cum[p]; span > 0 {
+          s.dist[i] += (s.cum[i] - s.cum[p]) / span * (s.dist[q] - s.dist[p])
+        }
+    }
+  }
+}
+
+// queryRefTrips Helper: Retrieve stops (with coordinates) of each trip
+// with a shape, grouped by shape_id, then by trip (ordered by sequence).
+func queryRefTrips(db *sql.DB) (map[string][][]refStop, error) {
+  rows, qErr := db.Query(`
+    select st.rowid, st.trip_id, t.shape_id, st.stop_id,
+      cast(s.stop_lat as real), cast(s.stop_lon as real)
+    from stop_times st
+      join trips t on t.trip_id = st.trip_id
+      join stops s on s.stop_id = st.stop_id
+    where t.shape_id != '' and s.stop_lat != '' and s.stop_lon != ''
+    order by st.trip_id, cast(st.stop_sequence as int);`)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select stop_times [%s]", qErr)
+  }
+  defer rows.Close()
+
+  trips := map[string][][]refStop{}
+  var prevTrip string
+  for rows.Next() {
+    var st refStop
+    var tripID, shapeID string
+    if sErr := rows.Scan(&st.rowid, &tripID, &shapeID, &st.stopID,
+      &st.lat, &st.lon); sErr != nil {
+      return nil, fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    // group by shape, then trip
+    if tripID != prevTrip {
+      trips[shapeID] = append(trips[shapeID], nil)
+      prevTrip = tripID
+    }
+    t := trips[shapeID]
+    t[len(t)-1] = append(t[len(t)-1], st)
+  }
+
+  return trips, nil
+}
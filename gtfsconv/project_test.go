@@ -0,0 +1,79 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "reflect"
+  "testing"
+  "database/sql"
+)
+
+func TestProjectStops(t *testing.T) {
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1) // each connection is its own db
+  defer db.Close()
+
+  // SH1 in kilometers (with a blank point), SH2 without any values;
+  // stop C of T1 has an existing (kept) value
+  if _, eErr := db.Exec(`
+    create table shapes (shape_id text, shape_pt_lat text,
+      shape_pt_lon text, shape_pt_sequence text, shape_dist_traveled text);
+    create table stops (stop_id text, stop_lat text, stop_lon text);
+    create table trips (trip_id text, shape_id text);
+    create table stop_times (trip_id text, stop_id text, stop_sequence text,
+      shape_dist_traveled text);
+    insert into shapes values
+      ('SH1', '40.700', '-74.000', '1', '0'),
+      ('SH1', '40.709', '-74.000', '2', ''),
+      ('SH1', '40.718', '-74.000', '3', '2'),
+      ('SH2', '40.700', '-74.000', '1', null),
+      ('SH2', '40.709', '-74.000', '2', null);
+    insert into stops values ('A', '40.700', '-74.000'),
+      ('B', '40.7045', '-74.000'), ('C', '40.718', '-74.000');
+    insert into trips values ('T1', 'SH1'), ('T2', 'SH2');
+    insert into stop_times values ('T1', 'A', '1', ''), ('T1', 'B', '2', ''),
+      ('T1', 'C', '3', '2.5'), ('T2', 'A', '1', ''), ('T2', 'B', '2', null);`);
+    eErr != nil {
+    t.Fatalf("db.Exec() %s", eErr)
+  }
+
+  if pErr := projectStops(db, 100); pErr != nil {
+    t.Fatalf("projectStops() %s", pErr)
+  }
+
+  query := func(q string) []string {
+    rows, qErr := db.Query(q)
+    if qErr != nil {
+      t.Fatalf("db.Query() %s", qErr)
+    }
+    defer rows.Close()
+
+    var got []string
+    for rows.Next() {
+      var id string
+      var d float64
+      if sErr := rows.Scan(&id, &d); sErr != nil {
+        t.Fatalf("rows.Scan() %s", sErr)
+      }
+      got = append(got, fmt.Sprintf("%s %.1f", id, d))
+    }
+    return got
+  }
+
+  shapes := query("select shape_id, cast(shape_dist_traveled as real) " +
+    "from shapes order by shape_id, cast(shape_pt_sequence as int);")
+  if want := []string{"SH1 0.0", "SH1 1.0", "SH1 2.0", "SH2 0.0",
+    "SH2 1000.8"}; reflect.DeepEqual(shapes, want) == false {
+    t.Errorf("shapes = %q, want %q", shapes, want)
+  }
+
+  stopTimes := query("select trip_id || ' ' || stop_id, " +
+    "cast(shape_dist_traveled as real) from stop_times " +
+    "order by trip_id, cast(stop_sequence as int);")
+  if want := []string{"T1 A 0.0", "T1 B 0.5", "T1 C 2.5", "T2 A 0.0",
+    "T2 B 500.4"}; reflect.DeepEqual(stopTimes, want) == false {
+    t.Errorf("stop_times = %q, want %q", stopTimes, want)
+  }
+}
@@ -0,0 +1,493 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "regexp"
+  "sort"
+  "strconv"
+  "database/sql"
+)
+
+// raptorInf: unreached arrival time
+const raptorInf = math.MaxInt32
+
+// raptor label kinds (how a stop was reached)
+const (
+  labelNone = iota
+  labelAccess
+  labelTransit
+  labelWalk
+)
+
+// raptorLabel Type Helper: how a stop was reached, in a RAPTOR round.
+type raptorLabel struct {
+  arr       int
+  kind      int
+  round     int      // round of label (labels are kept in later rounds)
+  from      int      // boarding stop (transit), or origin stop (walk)
+  route     *ttRoute // transit only
+  trip      *ttTrip  // transit only
+  boardPos  int      // transit only
+  alightPos int      // transit only
+}
+
+// Place is an origin or destination, a stop (or parent station, as any
+// of its stops), or coordinates (if StopID is empty).
+type Place struct {
+  StopID    string
+  Lat, Lon  float64
+}
+
+// PlanOptions are the options of journey planning (see Plan).
+type PlanOptions struct {
+  MaxTransfers  int     // max transfers (between trips)
+  MaxWalk       float64 // max walk (in meters), from/to coordinates
+  WalkSpeed     float64 // walking speed (in m/s), for walks without time
+}
+
+// Itinerary is a journey, of walks and transit legs (see Plan).
+type Itinerary struct {
+  Departure int // seconds since midnight (of service date)
+  Arrival   int // seconds since midnight (of service date)
+  Transfers int
+  Legs      []Leg
+}
+
+// Leg is part of an Itinerary, a walk or a trip.
+type Leg struct {
+  Mode        string  // "walk", or "transit"
+  FromStopID  string  // empty, if from coordinates
+  FromName    string
+  ToStopID    string  // empty, if to coordinates
+  ToName      string
+  Departure   int     // seconds since midnight (of service date)
+  Arrival     int     // seconds since midnight (of service date)
+  RouteID     string  // transit only
+  RouteName   string  // transit only
+  TripID      string  // transit only
+  Headsign    string  // transit only
+  ServiceDate string  // transit only (previous date, if past midnight)
+  Distance    float64 // walk only (in meters, 0 if unknown)
+  Path        [][2]float64 // [lon, lat] of each stop (or coordinates)
+}
+
+// placeCoords: "lat,lon" coordinates (see ParsePlace)
+var placeCoords = regexp.MustCompile(
+  `^\s*(-?[0-9]+(?:\.[0-9]+)?)\s*,\s*(-?[0-9]+(?:\.[0-9]+)?)\s*$`)
+
+// ParsePlace parses a Place, as "lat,lon" coordinates, or a stop_id.
+func ParsePlace(s string) Place {
+  if m := placeCoords.FindStringSubmatch(s); m != nil {
+    lat, _ := strconv.ParseFloat(m[1], 64)
+    lon, _ := strconv.ParseFloat(m[2], 64)
+    return Place{Lat: lat, Lon: lon}
+  }
+  return Place{StopID: s}
+}
+
+// DefaultPlanOptions returns PlanOptions with default values.
+func DefaultPlanOptions() PlanOptions {
+  return PlanOptions{MaxTransfers: 4, MaxWalk: 500, WalkSpeed: 1.2}
+}
+
+// Plan loads the timetable of a service date (see LoadTimetable), and
+// returns Pareto-optimal itineraries (see Timetable.Plan).
+func Plan(db *sql.DB, from, to Place, date string, departure int,
+  popt PlanOptions) ([]Itinerary, error) {
+  tt, tErr := LoadTimetable(db, date)
+  if tErr != nil {
+    return nil, fmt.Errorf("LoadTimetable() %s", tErr)
+  }
+  return tt.Plan(from, to, departure, popt)
+}
+
+// Plan returns Pareto-optimal itineraries (earliest arrival, for each
+// number of transfers), from a place to another, departing at (or after)
+// departure (seconds since midnight), using RAPTOR.
+func (tt *Timetable) Plan(from, to Place, departure int,
+  popt PlanOptions) ([]Itinerary, error) {
+  if popt.WalkSpeed <= 0 {
+    return nil, fmt.Errorf("invalid walk speed")
+  }
+
+  access, aErr := tt.placeStops(from, popt)
+  if aErr != nil {
+    return nil, fmt.Errorf("invalid origin, %s", aErr)
+  }
+  egress, eErr := tt.placeStops(to, popt)
+  if eErr != nil {
+    return nil, fmt.Errorf("invalid destination, %s", eErr)
+  }
+
+  for s, secs := range access {
+    access[s] = departure + secs
+  }
+  labels := tt.raptor(access, popt.MaxTransfers + 1, popt.WalkSpeed, egress)
+
+  // best arrival at destination, of each round (if improved)
+  var itineraries []Itinerary
+  best := raptorInf
+  for k := range labels {
+    stop, arr := -1, best
+    for s, secs := range egress {
+      if l := labels[k][s]; l.arr < raptorInf && l.arr + secs < arr {
+        stop, arr = s, l.arr + secs
+      }
+    }
+    if stop < 0 {
+      continue
+    }
+    best = arr
+    itineraries = append(itineraries,
+      tt.itinerary(labels, k, stop, from, to, egress[stop], popt))
+  }
+
+  return itineraries, nil
+}
+
+// placeStops Helper: Stops of a place, with walk time (in seconds), the
+// stop itself (or child stops of a parent station), or stops within
+// max walk of coordinates.
+func (tt *Timetable) placeStops(p Place,
+  popt PlanOptions) (map[int]int, error) {
+  stops := map[int]int{}
+
+  if p.StopID != "" {
+    s, ok := tt.stopIdx[p.StopID]
+    if ok == false {
+      return nil, fmt.Errorf("unknown stop %q", p.StopID)
+    }
+    stops[s] = 0
+    for _, c := range tt.children[p.StopID] {
+      stops[c] = 0
+    }
+    return stops, nil
+  }
+
+  for i, s := range tt.stops {
+    if s.located == false {
+      continue
+    }
+    if d := haversine(p.Lat, p.Lon, s.lat, s.lon); d <= popt.MaxWalk {
+      stops[i] = int(math.Ceil(d / popt.WalkSpeed))
+    }
+  }
+  if len(stops) == 0 {
+    return nil, fmt.Errorf("no stops within %.0fm of %f,%f",
+      popt.MaxWalk, p.Lat, p.Lon)
+  }
+  return stops, nil
+}
+
+// walkSecs Helper: Walk time (in seconds) of a walking transfer.
+func (fp ttFootpath) walkSecs(walkSpeed float64) int {
+  if fp.secs >= 0 {
+    return fp.secs
+  }
+  return int(math.Ceil(fp.distance / walkSpeed))
+}
+
+// raptorRun Type Helper: labels of each stop, for each round, and best
+// arrivals (of any round), kept across runs of a range query (see
+// raptorRange).
+type raptorRun struct {
+  labels [][]raptorLabel
+  best   []int
+}
+
+// newRaptorRun Helper: Empty labels (unreached), for up to maxRounds.
+func (tt *Timetable) newRaptorRun(maxRounds int) *raptorRun {
+  run := &raptorRun{labels: make([][]raptorLabel, maxRounds + 1),
+    best: make([]int, len(tt.stops))}
+  for i := range run.best {
+    run.best[i] = raptorInf
+  }
+  for k := range run.labels {
+    run.labels[k] = make([]raptorLabel, len(tt.stops))
+    for i := range run.labels[k] {
+      run.labels[k][i].arr = raptorInf
+    }
+  }
+  return run
+}
+
+// raptor Helper: Run RAPTOR from access stops (with arrival times), for
+// up to maxRounds trips, returning labels of each stop, for each round
+// (round 0 is access, and walking from it). With targets (stops, with
+// egress walk time), prunes arrivals later than the best at targets.
+func (tt *Timetable) raptor(access map[int]int, maxRounds int,
+  walkSpeed float64, targets map[int]int) [][]raptorLabel {
+  run := tt.newRaptorRun(maxRounds)
+  tt.raptorRange(run, access, walkSpeed, targets, raptorInf)
+  return run.labels
+}
+
+// raptorRange Helper: Run RAPTOR (see raptor) into run, keeping its
+// labels from previous runs (of later departures, i.e., range RAPTOR),
+// and pruning arrivals later than bound.
+func (tt *Timetable) raptorRange(run *raptorRun, access map[int]int,
+  walkSpeed float64, targets map[int]int, bound int) {
+  best := run.best
+  targetBest := raptorInf
+  marked := make([]bool, len(tt.stops))
+
+  // reach Helper: Set label (if improving), returns if improved
+  reach := func(labels []raptorLabel, s int, l raptorLabel) bool {
+    if l.arr >= best[s] || l.arr >= targetBest || l.arr > bound {
+      return false
+    }
+    labels[s], best[s], marked[s] = l, l.arr, true
+    if secs, ok := targets[s]; ok && l.arr + secs < targetBest {
+      targetBest = l.arr + secs
+    }
+    return true
+  }
+
+  // walk Helper: Walking transfers, from stops reached (not by walking)
+  walk := func(labels []raptorLabel, k int, from []int) {
+    for _, s := range from {
+      if labels[s].kind == labelWalk {
+        continue // only one walk, between trips
+      }
+      for _, fp := range tt.footpaths[s] {
+        reach(labels, fp.to, raptorLabel{kind: labelWalk, round: k, from: s,
+          arr: labels[s].arr + fp.walkSecs(walkSpeed)})
+      }
+    }
+  }
+
+  // round 0: access stops (and walking from them)
+  var reached []int
+  for s, arr := range access {
+    if reach(run.labels[0], s, raptorLabel{kind: labelAccess, arr: arr}) {
+      reached = append(reached, s)
+    }
+  }
+  sort.Ints(reached) // deterministic
+  walk(run.labels[0], 0, reached)
+
+  for k := 1; k < len(run.labels); k++ {
+    prev, cur := run.labels[k-1], run.labels[k]
+    for s := range cur { // labels are kept in later rounds
+      if prev[s].arr < cur[s].arr {
+        cur[s] = prev[s]
+      }
+    }
+
+    // routes serving marked stops, from earliest marked position
+    queue := map[int]int{}
+    for s := range marked {
+      if marked[s] == false {
+        continue
+      }
+      marked[s] = false
+      for _, rp := range tt.stopRoutes[s] {
+        if pos, ok := queue[rp[0]]; ok == false || rp[1] < pos {
+          queue[rp[0]] = rp[1]
+        }
+      }
+    }
+    if len(queue) == 0 {
+      continue // (still keeping labels, of previous round)
+    }
+    order := make([]int, 0, len(queue))
+    for r := range queue {
+      order = append(order, r)
+    }
+    sort.Ints(order) // deterministic
+
+    // scan each route, hopping on the earliest catchable trip
+    var transit []int
+    for _, r := range order {
+      route := tt.routes[r]
+      trip, boardStop, boardPos := -1, -1, -1
+      for i := queue[r]; i < len(route.stops); i++ {
+        s := route.stops[i]
+
+        if trip >= 0 && route.trips[trip].noAlight[i] == false {
+          if reach(cur, s, raptorLabel{kind: labelTransit, round: k,
+            from: boardStop, route: route, trip: route.trips[trip],
+            boardPos: boardPos, alightPos: i,
+            arr: route.trips[trip].arr[i]}) {
+            transit = append(transit, s)
+          }
+        }
+
+        // ready to board (after min transfer time, if by transit)
+        l := prev[s]
+        if l.arr == raptorInf {
+          continue
+        }
+        ready := l.arr
+        if l.kind == labelTransit {
+          ready += tt.minTransfer[s]
+        }
+        if trip >= 0 && ready > route.trips[trip].dep[i] {
+          continue
+        }
+
+        // earliest trip, departing at (or after) ready
+        t := sort.Search(len(route.trips), func(j int) bool {
+          return route.trips[j].dep[i] >= ready
+        })
+        for t < len(route.trips) && route.trips[t].noBoard[i] {
+          t++
+        }
+        if t < len(route.trips) && (trip < 0 || t < trip) {
+          trip, boardStop, boardPos = t, s, i
+        }
+      }
+    }
+
+    walk(cur, k, transit)
+  }
+}
+
+// itinerary Helper: Itinerary from labels, arriving at stop in round k
+// (then walking to destination, with egress walk time).
+func (tt *Timetable) itinerary(labels [][]raptorLabel, k, stop int,
+  from, to Place, egress int, popt PlanOptions) Itinerary {
+  var legs []Leg
+
+  // stopLeg Helper: Leg between two stops
+  stopLeg := func(mode string, a, b int) Leg {
+    sa, sb := tt.stops[a], tt.stops[b]
+    return Leg{Mode: mode, FromStopID: sa.id, FromName: sa.name,
+      ToStopID: sb.id, ToName: sb.name}
+  }
+
+  // backtrack, from (round, stop) to origin
+  r, s := k, stop
+  transfers := -1
+  for {
+    l := labels[r][s]
+    if l.kind == labelAccess {
+      if from.StopID == "" { // walk from coordinates
+        leg := stopLeg("walk", s, s)
+        leg.FromStopID, leg.FromName = "", placeName(from)
+        leg.Arrival = l.arr
+        leg.Distance = haversine(from.Lat, from.Lon,
+          tt.stops[s].lat, tt.stops[s].lon)
+        leg.Departure = l.arr - int(math.Ceil(leg.Distance / popt.WalkSpeed))
+        leg.Path = [][2]float64{{from.Lon, from.Lat},
+          {tt.stops[s].lon, tt.stops[s].lat}}
+        legs = append([]Leg{leg}, legs...)
+      }
+      break
+    }
+
+    switch l.kind {
+      case labelTransit:
+        leg := stopLeg("transit", l.from, s)
+        leg.Departure = l.trip.dep[l.boardPos]
+        leg.Arrival = l.arr
+        leg.RouteID, leg.RouteName = l.route.routeID, l.route.name
+        leg.TripID, leg.Headsign = l.trip.id, l.trip.headsign
+        leg.ServiceDate = l.trip.serviceDate
+        for _, p := range l.route.stops[l.boardPos:l.alightPos+1] {
+          leg.Path = append(leg.Path, [2]float64{tt.stops[p].lon,
+            tt.stops[p].lat})
+        }
+        legs = append([]Leg{leg}, legs...)
+        transfers++
+        r, s = l.round - 1, l.from
+
+      case labelWalk:
+        leg := stopLeg("walk", l.from, s)
+        leg.Departure = labels[l.round][l.from].arr
+        leg.Arrival = l.arr
+        for _, fp := range tt.footpaths[l.from] {
+          if fp.to == s {
+            leg.Distance = fp.distance
+          }
+        }
+        leg.Path = [][2]float64{{tt.stops[l.from].lon, tt.stops[l.from].lat},
+          {tt.stops[s].lon, tt.stops[s].lat}}
+        legs = append([]Leg{leg}, legs...)
+        r, s = l.round, l.from
+    }
+  }
+
+  // walk to coordinates
+  if to.StopID == "" {
+    leg := stopLeg("walk", stop, stop)
+    leg.ToStopID, leg.ToName = "", placeName(to)
+    leg.Departure = labels[k][stop].arr
+    leg.Arrival = leg.Departure + egress
+    leg.Distance = haversine(tt.stops[stop].lat, tt.stops[stop].lon,
+      to.Lat, to.Lon)
+    leg.Path = [][2]float64{{tt.stops[stop].lon, tt.stops[stop].lat},
+      {to.Lon, to.Lat}}
+    legs = append(legs, leg)
+  }
+
+  // leave as late as possible (walking just in time, for first trip)
+  for i, leg := range legs {
+    if leg.Mode != "transit" {
+      continue
+    }
+    if i > 0 {
+      shift := leg.Departure - legs[i-1].Arrival
+      for j := 0; j < i; j++ {
+        legs[j].Departure += shift
+        legs[j].Arrival += shift
+      }
+    }
+    break
+  }
+
+  it := Itinerary{Transfers: transfers, Legs: legs,
+    Departure: labels[k][stop].arr, Arrival: labels[k][stop].arr}
+  if transfers < 0 {
+    it.Transfers = 0
+  }
+  if len(legs) > 0 {
+    it.Departure, it.Arrival = legs[0].Departure, legs[len(legs)-1].Arrival
+  }
+  return it
+}
+
+// placeName Helper: Name of coordinates place.
+func placeName(p Place) string {
+  return fmt.Sprintf("%.5f,%.5f", p.Lat, p.Lon)
+}
+
+// ItinerariesGeoJSON returns itineraries as a GeoJSON FeatureCollection,
+// with a LineString of each leg.
+func ItinerariesGeoJSON(itineraries []Itinerary) map[string]interface{} {
+  features := []jsony{}
+  for i, it := range itineraries {
+    for j, leg := range it.Legs {
+      features = append(features, jsony{
+        "type": "Feature",
+        "properties": jsony{
+          "itinerary":    i + 1,
+          "leg":          j + 1,
+          "mode":         leg.Mode,
+          "from_stop_id": leg.FromStopID,
+          "from_name":    leg.FromName,
+          "to_stop_id":   leg.ToStopID,
+          "to_name":      leg.ToName,
+          "departure":    FormatClock(leg.Departure),
+          "arrival":      FormatClock(leg.Arrival),
+          "route_id":     leg.RouteID,
+          "route_name":   leg.RouteName,
+          "trip_id":      leg.TripID,
+          "headsign":     leg.Headsign,
+          "service_date": leg.ServiceDate,
+          "distance":     math.Round(leg.Distance),
+        },
+        "geometry": jsony{
+          "type": "LineString",
+          "coordinates": leg.Path,
+        },
+      })
+    }
+  }
+
+  return map[string]interface{}{
+    "type": "FeatureCollection",
+    "features": features,
+  }
+}
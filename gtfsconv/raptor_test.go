@@ -0,0 +1,179 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// describeItineraries Helper: Summary of each itinerary, as its legs.
+func describeItineraries(its []Itinerary) []string {
+  var got []string
+  for _, it := range its {
+    var legs []string
+    for _, l := range it.Legs {
+      leg := fmt.Sprintf("%s %s-%s %s-%s", l.Mode, l.FromStopID, l.ToStopID,
+        FormatClock(l.Departure), FormatClock(l.Arrival))
+      if l.Mode == "transit" {
+        leg = l.TripID + " " + leg
+      }
+      legs = append(legs, leg)
+    }
+    got = append(got, strings.Join(legs, ", "))
+  }
+  return got
+}
+
+func TestTimetablePlan(t *testing.T) {
+  stops := `
+    insert into stops values ('A', 'A', '40.700', '-74.000', ''),
+      ('B', 'B', '40.710', '-74.000', ''), ('C', 'C', '40.720', '-74.000', ''),
+      ('D', 'D', '40.730', '-74.000', ''), ('F', 'F', '40.711', '-74.000', '');
+    insert into routes values ('R1', '1', ''), ('R2', '2', ''),
+      ('R3', '3', '');
+    insert into service_dates values ('WK', '20260105');`
+
+  tests := []struct {
+    name      string
+    rows      string
+    from, to  string
+    departure string
+    want      []string
+  }{
+    {
+      name: "transfer waits for min_transfer_time",
+      rows: `
+        insert into trips values ('T1', 'R1', 'WK', ''),
+          ('T2', 'R2', 'WK', ''), ('T3', 'R2', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', ''),
+          ('T2', 'B', '1', 29520, 29520, '', ''),
+          ('T2', 'C', '2', 30000, 30000, '', ''),
+          ('T3', 'B', '1', 30000, 30000, '', ''),
+          ('T3', 'C', '2', 30600, 30600, '', '');
+        insert into transfers values ('B', 'B', '2', '300');`,
+      from: "A", to: "C", departure: "7:55",
+      want: []string{"T1 transit A-B 08:00:00-08:10:00, " +
+        "T3 transit B-C 08:20:00-08:30:00"},
+    },
+    {
+      name: "walking transfer between trips",
+      rows: `
+        insert into trips values ('T1', 'R1', 'WK', ''),
+          ('T2', 'R2', 'WK', ''), ('T3', 'R2', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', ''),
+          ('T2', 'F', '1', 29460, 29460, '', ''),
+          ('T2', 'D', '2', 30000, 30000, '', ''),
+          ('T3', 'F', '1', 29580, 29580, '', ''),
+          ('T3', 'D', '2', 30120, 30120, '', '');
+        insert into transfers values ('B', 'F', '2', '120');`,
+      from: "A", to: "D", departure: "7:55",
+      want: []string{"T1 transit A-B 08:00:00-08:10:00, " +
+        "walk B-F 08:10:00-08:12:00, T3 transit F-D 08:13:00-08:22:00"},
+    },
+    {
+      name: "past midnight trip of previous date",
+      rows: `
+        insert into service_dates values ('SU', '20260104');
+        insert into trips values ('N', 'R1', 'SU', '');
+        insert into stop_times values
+          ('N', 'A', '1', 88200, 88200, '', ''),
+          ('N', 'B', '2', 90000, 90000, '', '');`,
+      from: "A", to: "B", departure: "0:10",
+      want: []string{"N transit A-B 00:30:00-01:00:00"},
+    },
+    {
+      name: "no boarding (pickup_type 1)",
+      rows: `
+        insert into trips values ('X', 'R1', 'WK', ''), ('Y', 'R1', 'WK', '');
+        insert into stop_times values
+          ('X', 'A', '1', 28800, 28800, '1', ''),
+          ('X', 'C', '2', 30000, 30000, '', ''),
+          ('Y', 'A', '1', 30600, 30600, '', ''),
+          ('Y', 'C', '2', 31800, 31800, '', '');`,
+      from: "A", to: "C", departure: "7:55",
+      want: []string{"Y transit A-C 08:30:00-08:50:00"},
+    },
+    {
+      name: "no alighting (drop_off_type 1)",
+      rows: `
+        insert into trips values ('X', 'R1', 'WK', ''), ('Y', 'R1', 'WK', '');
+        insert into stop_times values
+          ('X', 'A', '1', 28800, 28800, '', ''),
+          ('X', 'B', '2', 29400, 29400, '', '1'),
+          ('X', 'C', '3', 30000, 30000, '', ''),
+          ('Y', 'A', '1', 30600, 30600, '', ''),
+          ('Y', 'B', '2', 31200, 31200, '', ''),
+          ('Y', 'C', '3', 31800, 31800, '', '');`,
+      from: "A", to: "B", departure: "7:55",
+      want: []string{"Y transit A-B 08:30:00-08:40:00"},
+    },
+    {
+      name: "pareto itineraries, fewer transfers then earlier arrival",
+      rows: `
+        insert into trips values ('S', 'R1', 'WK', ''),
+          ('T1', 'R2', 'WK', ''), ('T2', 'R3', 'WK', '');
+        insert into stop_times values
+          ('S', 'A', '1', 28800, 28800, '', ''),
+          ('S', 'C', '2', 32400, 32400, '', ''),
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', ''),
+          ('T2', 'B', '1', 29700, 29700, '', ''),
+          ('T2', 'C', '2', 30600, 30600, '', '');`,
+      from: "A", to: "C", departure: "7:55",
+      want: []string{"S transit A-C 08:00:00-09:00:00",
+        "T1 transit A-B 08:00:00-08:10:00, " +
+        "T2 transit B-C 08:15:00-08:30:00"},
+    },
+    {
+      name: "no itinerary after last trip",
+      rows: `
+        insert into trips values ('T1', 'R1', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', '');`,
+      from: "A", to: "B", departure: "8:01",
+      want: nil,
+    },
+  }
+
+  for _, tc := range tests {
+    t.Run(tc.name, func(t *testing.T) {
+      db := openTestDB(t, stops + tc.rows)
+      tt, lErr := LoadTimetable(db, "20260105")
+      if lErr != nil {
+        t.Fatalf("LoadTimetable() %s", lErr)
+      }
+      departure, cErr := ParseClock(tc.departure)
+      if cErr != nil {
+        t.Fatalf("ParseClock() %s", cErr)
+      }
+
+      its, pErr := tt.Plan(Place{StopID: tc.from}, Place{StopID: tc.to},
+        departure, DefaultPlanOptions())
+      if pErr != nil {
+        t.Fatalf("Plan() %s", pErr)
+      }
+      if got := describeItineraries(its); reflect.DeepEqual(got,
+        tc.want) == false {
+        t.Errorf("itineraries =\n  %q\nwant\n  %q", got, tc.want)
+      }
+    })
+  }
+}
+
+func TestTimetablePlanUnknownStop(t *testing.T) {
+  db := openTestDB(t, "insert into stops values ('A', 'A', '', '', '');")
+  tt, lErr := LoadTimetable(db, "20260105")
+  if lErr != nil {
+    t.Fatalf("LoadTimetable() %s", lErr)
+  }
+  if _, pErr := tt.Plan(Place{StopID: "A"}, Place{StopID: "Z"}, 0,
+    DefaultPlanOptions()); pErr == nil {
+    t.Errorf("Plan() to unknown stop, expected error")
+  }
+}
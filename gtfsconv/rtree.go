@@ -0,0 +1,108 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "sort"
+  "database/sql"
+)
+
+// NearbyStop Type Helper: stop within a radius (see NearbyStops).
+type NearbyStop struct {
+  StopID    string
+  Name      string
+  Lat, Lon  float64
+  Distance  float64 // in meters
+}
+
+// buildRTree creates sqlite r*tree spatial indexes, "stops_rtree" and
+// "shapes_rtree" (bounding boxes, with stop_id/shape_id), from "stops"
+// and "shapes" tables (so, available with or without spatialite).
+func buildRTree(db *sql.DB) error {
+
+  // (re)create "stops_rtree" table
+  if _, cErr := db.Exec(`
+    drop table if exists stops_rtree;
+    create virtual table stops_rtree using rtree
+      (id, minx, maxx, miny, maxy, +stop_id);
+
+    insert into stops_rtree (minx, maxx, miny, maxy, stop_id)
+    select cast(stop_lon as real), cast(stop_lon as real),
+      cast(stop_lat as real), cast(stop_lat as real), stop_id
+    from stops where stop_lat != '' and stop_lon != '';`); cErr != nil {
+    return fmt.Errorf("failed to create table `stops_rtree` [%s]", cErr)
+  }
+
+  // (re)create "shapes_rtree" table (only, if "shapes" table exists)
+  if hasDBTable(db, "shapes") {
+    if _, cErr := db.Exec(`
+      drop table if exists shapes_rtree;
+      create virtual table shapes_rtree using rtree
+        (id, minx, maxx, miny, maxy, +shape_id);
+
+      insert into shapes_rtree (minx, maxx, miny, maxy, shape_id)
+      select min(cast(shape_pt_lon as real)), max(cast(shape_pt_lon as real)),
+        min(cast(shape_pt_lat as real)), max(cast(shape_pt_lat as real)),
+        shape_id
+      from shapes group by shape_id;`); cErr != nil {
+      return fmt.Errorf("failed to create table `shapes_rtree` [%s]", cErr)
+    }
+  }
+
+  return nil
+}
+
+// NearbyStops returns stops within radius (in meters) of lat/lon, ordered
+// by distance (up to limit, if > 0), using "stops_rtree" index (if exists).
+func NearbyStops(db *sql.DB, lat, lon, radius float64,
+  limit int) ([]NearbyStop, error) {
+
+  // bounding box (in degrees) of radius
+  dLat := radius / earthRadius * 180 / math.Pi
+  dLon := dLat / math.Max(0.01, math.Cos(lat * math.Pi / 180))
+  box := []interface{}{lon - dLon, lon + dLon, lat - dLat, lat + dLat}
+
+  // select stops within bounding box
+  query := `
+    select s.stop_id, s.stop_name, cast(s.stop_lat as real),
+      cast(s.stop_lon as real)
+    from stops_rtree r join stops s on s.stop_id = r.stop_id
+    where r.maxx >= ? and r.minx <= ? and r.maxy >= ? and r.miny <= ?;`
+  if hasDBTable(db, "stops_rtree") == false { // no index, scan all stops
+    query = `
+      select stop_id, stop_name, cast(stop_lat as real),
+        cast(stop_lon as real)
+      from stops where stop_lat != '' and stop_lon != ''
+        and cast(stop_lon as real) between ? and ?
+        and cast(stop_lat as real) between ? and ?;`
+  }
+
+  rows, qErr := db.Query(query, box...)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select nearby stops [%s]", qErr)
+  }
+  defer rows.Close()
+
+  // filter by actual distance
+  var stops []NearbyStop
+  for rows.Next() {
+    var s NearbyStop
+    if sErr := rows.Scan(&s.StopID, &s.Name, &s.Lat, &s.Lon); sErr != nil {
+      return nil, fmt.Errorf("failed to scan nearby stops [%s]", sErr)
+    }
+
+    s.Distance = haversine(lat, lon, s.Lat, s.Lon)
+    if s.Distance <= radius {
+      stops = append(stops, s)
+    }
+  }
+
+  sort.Slice(stops, func(i, j int) bool {
+    return stops[i].Distance < stops[j].Distance
+  })
+  if limit > 0 && len(stops) > limit {
+    stops = stops[:limit]
+  }
+
+  return stops, nil
+}
@@ -0,0 +1,118 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "strings"
+  "database/sql"
+)
+
+// SearchResult Type Helper: ranked match from full-text search.
+type SearchResult struct {
+  Kind        string  // "stop" or "route"
+  ID          string  // stop_id or route_id
+  Name        string  // stop_name or route_long_name
+  Code        string  // stop_code or route_short_name
+  Description string  // stop_desc or route_desc
+  Rank        float64 // bm25 rank (lower is better)
+}
+
+// probeFTS5 Helper: Check if fts5 is compiled into sqlite (before build).
+func probeFTS5() error {
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    return fmt.Errorf("sql.Open() %s", oErr)
+  }
+  defer db.Close()
+
+  if _, cErr := db.Exec("create virtual table temp.fts5_probe " +
+    "using fts5 (name);"); cErr != nil {
+    if strings.Contains(cErr.Error(), "no such module") {
+      return fmt.Errorf("search requires fts5, which is not compiled in " +
+        "(build with `go build -tags sqlite_fts5`)")
+    }
+    return fmt.Errorf("failed to probe fts5 [%s]", cErr)
+  }
+  return nil
+}
+
+// buildSearchIndex creates "search_index" fts5 table, with stops
+// (name, code, description) and routes (long name, short name,
+// description).
+// note: sqlite must be built with fts5 (see probeFTS5).
+func buildSearchIndex(db *sql.DB) error {
+
+  // (re)create "search_index" table
+  if _, cErr := db.Exec(`
+    drop table if exists search_index;
+    create virtual table search_index using fts5 (
+      kind unindexed, id unindexed, name, code, description,
+      tokenize = 'unicode61 remove_diacritics 2');`); cErr != nil {
+    return fmt.Errorf("failed to create table `search_index` [%s]", cErr)
+  }
+
+  if hasDBTable(db, "stops") {
+    if _, iErr := db.Exec(fmt.Sprintf(`
+      insert into search_index (kind, id, name, code, description)
+      select 'stop', stop_id, %s, %s, %s from stops;`,
+      optDBTableCol(db, "", "stops", "stop_name"),
+      optDBTableCol(db, "", "stops", "stop_code"),
+      optDBTableCol(db, "", "stops", "stop_desc"))); iErr != nil {
+      return fmt.Errorf("failed to index stops [%s]", iErr)
+    }
+  }
+
+  if hasDBTable(db, "routes") {
+    if _, iErr := db.Exec(fmt.Sprintf(`
+      insert into search_index (kind, id, name, code, description)
+      select 'route', route_id, %s, %s, %s from routes;`,
+      optDBTableCol(db, "", "routes", "route_long_name"),
+      optDBTableCol(db, "", "routes", "route_short_name"),
+      optDBTableCol(db, "", "routes", "route_desc"))); iErr != nil {
+      return fmt.Errorf("failed to index routes [%s]", iErr)
+    }
+  }
+
+  return nil
+}
+
+// Search returns ranked stops/routes matching term (each word is matched
+// as a prefix, ignoring case and diacritics), from "search_index" table.
+func Search(db *sql.DB, term string, limit int) ([]SearchResult, error) {
+  if hasDBTable(db, "search_index") == false {
+    return nil, fmt.Errorf("missing search_index table (build with search)")
+  }
+
+  // quote each word as fts5 prefix query (e.g., `"cafe"*`),
+  // so that user input is never read as fts5 query syntax
+  var words []string
+  for _, w := range strings.Fields(term) {
+    words = append(words, `"` + strings.Replace(w, `"`, `""`, -1) + `"*`)
+  }
+  if len(words) == 0 {
+    return nil, fmt.Errorf("missing search term")
+  }
+
+  // rank by bm25, weighting name > code > description
+  rows, qErr := db.Query(`
+    select kind, id, name, code, description,
+      bm25(search_index, 0, 0, 10.0, 5.0, 1.0) as rank
+    from search_index where search_index match ?
+    order by rank limit ?;`, strings.Join(words, " "), limit)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to query search_index [%s]", qErr)
+  }
+  defer rows.Close()
+
+  var results []SearchResult
+  for rows.Next() {
+    var r SearchResult
+    if sErr := rows.Scan(&r.Kind, &r.ID, &r.Name, &r.Code, &r.Description,
+      &r.Rank);
+      sErr != nil {
+      return nil, fmt.Errorf("failed to scan search_index [%s]", sErr)
+    }
+    results = append(results, r)
+  }
+
+  return results, nil
+}
@@ -0,0 +1,343 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "sort"
+  "database/sql"
+)
+
+// segmentStats Type Helper: aggregated trips between two consecutive stops.
+type segmentStats struct {
+  from, to  string
+  shapeID   string  // shape of the first trip along a shape (if any)
+  shapeFrom float64 // projected distance along shape (in meters)
+  shapeTo   float64
+  numTrips  int
+  distSum   float64 // sum of distances (in meters), of all trips
+  timed     runStats
+  periods   map[string]*runStats
+}
+
+// runStats Type Helper: aggregated scheduled run times (of timed trips).
+type runStats struct {
+  numTrips  int
+  distSum   float64 // in meters
+  runSum    int     // in seconds
+  minRun    int
+  maxRun    int
+}
+
+// add Helper: Aggregate one timed trip.
+func (rs *runStats) add(dist float64, run int) {
+  if rs.numTrips == 0 || run < rs.minRun {
+    rs.minRun = run
+  }
+  if rs.numTrips == 0 || run > rs.maxRun {
+    rs.maxRun = run
+  }
+  rs.numTrips++
+  rs.distSum += dist
+  rs.runSum += run
+}
+
+// speed Helper: Average speed (in km/h), or nil (if not timed).
+func (rs *runStats) speed() interface{} {
+  if rs.runSum <= 0 {
+    return nil
+  }
+  return math.Round(rs.distSum / float64(rs.runSum) * 3.6 * 10) / 10
+}
+
+// avgRun Helper: Average run time (in seconds), or nil (if not timed).
+func (rs *runStats) avgRun() interface{} {
+  if rs.numTrips == 0 {
+    return nil
+  }
+  return math.Round(float64(rs.runSum) / float64(rs.numTrips) * 10) / 10
+}
+
+// segStop Type Helper: "stop_times" row, for building segments.
+type segStop struct {
+  refStop
+  located            bool // if stop has coordinates
+  arrival, departure sql.NullInt64
+}
+
+// buildSegments creates "segments" (each pair of consecutive stops of
+// any trip), with distance (along shape, if available, otherwise straight
+// line), scheduled run times, average speeds and trip counts, and
+// "segment_periods" with the same, per time-of-day period.
+// note: pairs with a stop without coordinates are skipped (never bridged).
+func buildSegments(db *sql.DB, periods []timePeriod) error {
+
+  // sanity check for derived "seconds" columns
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return rErr
+  }
+
+  // (re)create segment tables
+  if _, cErr := db.Exec(`
+    drop table if exists segments;
+    create table segments (segment_id integer primary key,
+      from_stop_id text, to_stop_id text, distance real, num_trips integer,
+      min_run_secs integer, avg_run_secs real, max_run_secs integer,
+      avg_speed real, shape_id text, shape_start real, shape_end real);
+
+    drop table if exists segment_periods;
+    create table segment_periods (segment_id integer, period text,
+      num_trips integer, avg_run_secs real, avg_speed real);`);
+    cErr != nil {
+    return fmt.Errorf("failed to create segment tables [%s]", cErr)
+  }
+
+  // retrieve shapes (for distance along shape)
+  shapes := map[string]*refShape{}
+  if hasDBTable(db, "shapes") {
+    var sErr error
+    if shapes, sErr = queryRefShapes(db); sErr != nil {
+      return fmt.Errorf("queryRefShapes() %s", sErr)
+    }
+  }
+
+  // stop times of each trip (each frequency-based run, if expanded)
+  stopTimes, tripJoin := "stop_times", "t.trip_id = st.trip_id"
+  if hasDBTable(db, "stop_times_expanded") {
+    stopTimes, tripJoin = "stop_times_expanded",
+      "t.trip_id = st.template_trip_id"
+  }
+  shapeID := optDBTableCol(db, "t", "trips", "shape_id")
+
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select st.trip_id, %s, st.stop_id,
+      coalesce(s.stop_lat != '' and s.stop_lon != '', 0),
+      coalesce(cast(s.stop_lat as real), 0),
+      coalesce(cast(s.stop_lon as real), 0),
+      st.arrival_secs, st.departure_secs
+    from %s st
+      join trips t on %s
+      left join stops s on s.stop_id = st.stop_id
+    order by st.trip_id, cast(st.stop_sequence as int);`,
+    shapeID, stopTimes, tripJoin))
+  if qErr != nil {
+    return fmt.Errorf("failed to query stop_times [%s]", qErr)
+  }
+
+  segments := map[[2]string]*segmentStats{}
+  projected := map[string][]refStop{} // by shape and stop pattern
+
+  // aggregate consecutive stops of a trip
+  addTrip := func(shapeID string, trip []segStop) {
+    if len(trip) < 2 {
+      return
+    }
+
+    // project (located stops) onto shape, if available
+    // (once per shape and pattern)
+    var located []int
+    for i := range trip {
+      if trip[i].located {
+        located = append(located, i)
+      }
+    }
+    s, hasShape := shapes[shapeID]
+    if hasShape && len(located) > 0 {
+      key := shapeID
+      for _, i := range located {
+        key += "\x00" + trip[i].stopID
+      }
+      p, ok := projected[key]
+      if ok == false {
+        p = make([]refStop, len(located))
+        for j, i := range located {
+          p[j] = trip[i].refStop
+        }
+        projectTrip(s, p)
+        projected[key] = p
+      }
+      for j, i := range located {
+        trip[i].meters = p[j].meters
+      }
+    }
+
+    for i := 1; i < len(trip); i++ {
+      a, b := trip[i-1], trip[i]
+      if a.located == false || b.located == false {
+        continue // no coordinates, skip segment
+      }
+
+      dist := b.meters - a.meters
+      alongShape := hasShape && dist > 0
+      if alongShape == false {
+        dist = haversine(a.lat, a.lon, b.lat, b.lon)
+      }
+
+      k := [2]string{a.stopID, b.stopID}
+      seg, ok := segments[k]
+      if ok == false {
+        seg = &segmentStats{from: k[0], to: k[1],
+          periods: map[string]*runStats{}}
+        segments[k] = seg
+      }
+      if alongShape && seg.shapeID == "" {
+        seg.shapeID, seg.shapeFrom, seg.shapeTo = shapeID, a.meters, b.meters
+      }
+      seg.numTrips++
+      seg.distSum += dist
+
+      // scheduled run time, from departure (or arrival) to next arrival
+      dep := a.departure
+      if dep.Valid == false {
+        dep = a.arrival
+      }
+      arr := b.arrival
+      if arr.Valid == false {
+        arr = b.departure
+      }
+      if dep.Valid == false || arr.Valid == false || arr.Int64 < dep.Int64 {
+        continue // not timed
+      }
+      run := int(arr.Int64 - dep.Int64)
+      seg.timed.add(dist, run)
+
+      if name := periodOf(periods, int(dep.Int64)); name != "" {
+        if seg.periods[name] == nil {
+          seg.periods[name] = &runStats{}
+        }
+        seg.periods[name].add(dist, run)
+      }
+    }
+  }
+
+  var tripID, tripShape string
+  var trip []segStop
+  for rows.Next() {
+    var id, sid string
+    var st segStop
+    if sErr := rows.Scan(&id, &sid, &st.stopID, &st.located, &st.lat,
+      &st.lon, &st.arrival, &st.departure); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    if id != tripID { // next trip
+      addTrip(tripShape, trip)
+      tripID, tripShape, trip = id, sid, nil
+    }
+    trip = append(trip, st)
+  }
+  addTrip(tripShape, trip)
+  rows.Close()
+
+  // insert segments (ordered, for stable segment ids)
+  keys := make([][2]string, 0, len(segments))
+  for k := range segments {
+    keys = append(keys, k)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    return keys[i][0] < keys[j][0] ||
+      (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+  })
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for i, k := range keys {
+    seg := segments[k]
+
+    var minRun, maxRun interface{} // null, if not timed
+    if seg.timed.numTrips > 0 {
+      minRun, maxRun = seg.timed.minRun, seg.timed.maxRun
+    }
+    var shapeID, shapeStart, shapeEnd interface{} // null, if no shape
+    if seg.shapeID != "" {
+      shapeID = seg.shapeID
+      shapeStart = math.Round(seg.shapeFrom * 10) / 10
+      shapeEnd = math.Round(seg.shapeTo * 10) / 10
+    }
+
+    if _, iErr := tx.Exec("insert into segments (segment_id, " +
+      "from_stop_id, to_stop_id, distance, num_trips, min_run_secs, " +
+      "avg_run_secs, max_run_secs, avg_speed, shape_id, shape_start, " +
+      "shape_end) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);", i+1,
+      seg.from, seg.to,
+      math.Round(seg.distSum / float64(seg.numTrips) * 10) / 10,
+      seg.numTrips, minRun, seg.timed.avgRun(), maxRun, seg.timed.speed(),
+      shapeID, shapeStart, shapeEnd); iErr != nil {
+      return fmt.Errorf("failed to insert into `segments` [%s]", iErr)
+    }
+
+    for _, p := range periods {
+      rs, ok := seg.periods[p.name]
+      if ok == false {
+        continue
+      }
+      if _, iErr := tx.Exec("insert into segment_periods (segment_id, " +
+        "period, num_trips, avg_run_secs, avg_speed) " +
+        "values (?, ?, ?, ?, ?);", i+1, p.name, rs.numTrips, rs.avgRun(),
+        rs.speed()); iErr != nil {
+        return fmt.Errorf("failed to insert into `segment_periods` [%s]", iErr)
+      }
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  // add indexes
+  if _, ciErr := db.Exec(`
+    create unique index segments_idx on segments (from_stop_id, to_stop_id);
+    create index segments_to_idx on segments (to_stop_id);
+    create index segment_periods_idx on segment_periods (segment_id);`);
+    ciErr != nil {
+    return fmt.Errorf("failed add index(es) to segments [%s]", ciErr)
+  }
+
+  return nil
+}
+
+// cut Helper: [lon, lat] points of shape between two distances along it
+// (in meters, see refShape.cum), interpolating both ends.
+func (s *refShape) cut(from, to float64) [][2]float64 {
+  point := func(m float64) [2]float64 {
+    n := len(s.cum)
+    j := sort.SearchFloat64s(s.cum, m) // first point at, or after, m
+    switch {
+      case j == 0: return [2]float64{s.points[0][1], s.points[0][0]}
+      case j >= n: return [2]float64{s.points[n-1][1], s.points[n-1][0]}
+    }
+
+    a, b := s.points[j-1], s.points[j]
+    t := 0.0
+    if span := s.cum[j] - s.cum[j-1]; span > 0 {
+      t = (m - s.cum[j-1]) / span
+    }
+    return [2]float64{a[1] + t*(b[1]-a[1]), a[0] + t*(b[0]-a[0])}
+  }
+
+  line := [][2]float64{point(from)}
+  for i, m := range s.cum {
+    if m > from && m < to {
+      line = append(line, [2]float64{s.points[i][1], s.points[i][0]})
+    }
+  }
+  return append(line, point(to))
+}
+
+// speedColor Helper: Color (hex) of average speed (in km/h), from red
+// (slow) to green (fast), or gray (if not timed).
+func speedColor(speed interface{}) string {
+  kmh, ok := speed.(float64)
+  switch {
+    case ok == false: return "#999999"
+    case kmh < 10: return "#d73027"
+    case kmh < 20: return "#fc8d59"
+    case kmh < 30: return "#fee08b"
+    case kmh < 45: return "#91cf60"
+    default: return "#1a9850"
+  }
+}
@@ -0,0 +1,98 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "math"
+  "reflect"
+  "testing"
+  "database/sql"
+)
+
+func TestBuildSegments(t *testing.T) {
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1) // each connection is its own db
+  defer db.Close()
+
+  // stop X (of T1) has no coordinates, T2 has no shape
+  if _, eErr := db.Exec(`
+    create table shapes (shape_id text, shape_pt_lat text,
+      shape_pt_lon text, shape_pt_sequence text);
+    create table stops (stop_id text, stop_lat text, stop_lon text);
+    create table trips (trip_id text, shape_id text);
+    create table stop_times (trip_id text, stop_id text, stop_sequence text,
+      arrival_secs integer, departure_secs integer);
+    insert into shapes values ('SH1', '40.700', '-74.000', '1'),
+      ('SH1', '40.710', '-74.000', '2'), ('SH1', '40.710', '-73.990', '3');
+    insert into stops values ('A', '40.700', '-74.000'), ('X', '', ''),
+      ('B', '40.705', '-74.000'), ('C', '40.710', '-73.990');
+    insert into trips values ('T1', 'SH1'), ('T2', '');
+    insert into stop_times values
+      ('T1', 'A', '1', 28800, 28800), ('T1', 'X', '2', 28860, 28860),
+      ('T1', 'B', '3', 28920, 28920), ('T1', 'C', '4', 29100, 29100),
+      ('T2', 'A', '1', 30000, 30000), ('T2', 'C', '2', 30300, 30300);`);
+    eErr != nil {
+    t.Fatalf("db.Exec() %s", eErr)
+  }
+
+  if bErr := buildSegments(db, nil); bErr != nil {
+    t.Fatalf("buildSegments() %s", bErr)
+  }
+
+  rows, qErr := db.Query("select from_stop_id, to_stop_id, num_trips, " +
+    "coalesce(shape_id, ''), coalesce(shape_start, 0), " +
+    "coalesce(shape_end, 0) from segments order by segment_id;")
+  if qErr != nil {
+    t.Fatalf("db.Query() %s", qErr)
+  }
+  defer rows.Close()
+
+  var got []string
+  for rows.Next() {
+    var from, to, shapeID string
+    var n int
+    var start, end float64
+    if sErr := rows.Scan(&from, &to, &n, &shapeID, &start, &end);
+      sErr != nil {
+      t.Fatalf("rows.Scan() %s", sErr)
+    }
+    got = append(got, fmt.Sprintf("%s-%s %d %s %.0f-%.0f", from, to, n,
+      shapeID, start, end))
+  }
+
+  // no A-B segment (bridging X), A-C only straight (T2)
+  want := []string{"A-C 1  0-0", "B-C 1 SH1 556-1955"}
+  if reflect.DeepEqual(got, want) == false {
+    t.Errorf("segments = %q, want %q", got, want)
+  }
+}
+
+func TestRefShapeCut(t *testing.T) {
+  s := &refShape{
+    points: [][2]float64{{40.70, -74.00}, {40.71, -74.00}, {40.71, -73.99}},
+    cum:    []float64{0, 1000, 2000},
+  }
+
+  tests := []struct {
+    from, to  float64
+    want      [][2]float64 // [lon, lat]
+  }{
+    {500, 1500, [][2]float64{{-74, 40.705}, {-74, 40.71}, {-73.995, 40.71}}},
+    {0, 1000, [][2]float64{{-74, 40.7}, {-74, 40.71}}},
+    {1200, 1800, [][2]float64{{-73.998, 40.71}, {-73.992, 40.71}}},
+  }
+
+  for _, tc := range tests {
+    got := s.cut(tc.from, tc.to)
+    for i := range got {
+      for k := range got[i] {
+        got[i][k] = math.Round(got[i][k] * 1e6) / 1e6
+      }
+    }
+    if reflect.DeepEqual(got, tc.want) == false {
+      t.Errorf("cut(%v, %v) = %v, want %v", tc.from, tc.to, got, tc.want)
+    }
+  }
+}
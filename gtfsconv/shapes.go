@@ -0,0 +1,163 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "strings"
+  "database/sql"
+)
+
+// genShape Type Helper: straight-line shape of a distinct stop pattern.
+type genShape struct {
+  id      string
+  points  [][2]float64  // [lat, lon] of each stop
+  trips   []string      // trips with this stop pattern
+}
+
+// generateShapes synthesizes straight-line shapes (through each stop)
+// for trips without a shape (e.g., feeds without "shapes.txt"), one per
+// distinct stop pattern, into "shapes" table (with "generated" = 1),
+// and assigns "trips.shape_id" of each trip.
+func generateShapes(db *sql.DB) error {
+
+  // ensure "shapes" table (with "generated" flag column)
+  if hasDBTable(db, "shapes") == false {
+    if _, cErr := db.Exec(`
+      create table shapes (shape_id text, shape_pt_lat text,
+        shape_pt_lon text, shape_pt_sequence text,
+        generated integer default 0);
+      create index shape_idx on shapes (shape_id);`); cErr != nil {
+      return fmt.Errorf("failed to create table `shapes` [%s]", cErr)
+    }
+  } else if hasDBTableCol(db, "shapes", "generated") == false {
+    if _, aErr := db.Exec(
+      "alter table shapes add column generated integer default 0;");
+      aErr != nil {
+      return fmt.Errorf("failed to add `generated` column [%s]", aErr)
+    }
+  }
+
+  // ensure "trips.shape_id" column
+  if hasDBTableCol(db, "trips", "shape_id") == false {
+    if _, aErr := db.Exec(`
+      alter table trips add column shape_id text;
+      create index if not exists t_shape_idx on trips (shape_id);`);
+      aErr != nil {
+      return fmt.Errorf("failed to add `shape_id` column [%s]", aErr)
+    }
+  }
+
+  // remove previously generated shapes (if re-generating)
+  if _, dErr := db.Exec(`
+    update trips set shape_id = null where shape_id in
+      (select shape_id from shapes where generated = 1);
+    delete from shapes where generated = 1;`); dErr != nil {
+    return fmt.Errorf("failed to delete generated shapes [%s]", dErr)
+  }
+
+  // collect existing shape ids (to avoid collisions)
+  existing := map[string]bool{}
+  ids, iErr := db.Query("select distinct shape_id from shapes;")
+  if iErr != nil {
+    return fmt.Errorf("failed to select shapes [%s]", iErr)
+  }
+  for ids.Next() {
+    var id string
+    if sErr := ids.Scan(&id); sErr != nil {
+      ids.Close()
+      return fmt.Errorf("failed to scan shapes [%s]", sErr)
+    }
+    existing[id] = true
+  }
+  ids.Close()
+
+  // retrieve stops of each trip without a (known) shape
+  rows, qErr := db.Query(`
+    select st.trip_id, st.stop_id,
+      cast(s.stop_lat as real), cast(s.stop_lon as real)
+    from trips t
+      join stop_times st on st.trip_id = t.trip_id
+      join stops s on s.stop_id = st.stop_id
+    where (t.shape_id is null or t.shape_id = ''
+      or not exists (select 1 from shapes where shape_id = t.shape_id))
+      and s.stop_lat != '' and s.stop_lon != ''
+    order by st.trip_id, cast(st.stop_sequence as int);`)
+  if qErr != nil {
+    return fmt.Errorf("failed to query stop_times [%s]", qErr)
+  }
+
+  // group trips by distinct stop pattern
+  var shapes []*genShape
+  patterns := map[string]*genShape{}
+  var tripID string
+  var stopIDs []string
+  var points [][2]float64
+  addTrip := func() {
+    if len(points) < 2 { // not a line
+      return
+    }
+    key := strings.Join(stopIDs, "\x00")
+    s, ok := patterns[key]
+    if ok == false {
+      s = &genShape{points: points}
+      patterns[key] = s
+      shapes = append(shapes, s)
+    }
+    s.trips = append(s.trips, tripID)
+  }
+
+  for rows.Next() {
+    var tid, sid string
+    var pt [2]float64
+    if sErr := rows.Scan(&tid, &sid, &pt[0], &pt[1]); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    if tid != tripID { // next trip
+      addTrip()
+      tripID, stopIDs, points = tid, nil, nil
+    }
+    stopIDs = append(stopIDs, sid)
+    points = append(points, pt)
+  }
+  addTrip()
+  rows.Close()
+
+  // insert generated shapes, and assign trips
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  n := 0
+  for _, s := range shapes {
+
+    // next unused shape id
+    for s.id == "" || existing[s.id] {
+      n++
+      s.id = fmt.Sprintf("generated_%d", n)
+    }
+
+    for i, pt := range s.points {
+      if _, iErr := tx.Exec("insert into shapes (shape_id, shape_pt_lat, " +
+        "shape_pt_lon, shape_pt_sequence, generated) values (?, ?, ?, ?, 1);",
+        s.id, pt[0], pt[1], i+1); iErr != nil {
+        return fmt.Errorf("failed to insert into `shapes` [%s]", iErr)
+      }
+    }
+
+    for _, t := range s.trips {
+      if _, uErr := tx.Exec("update trips set shape_id = ? where trip_id = ?;",
+        s.id, t); uErr != nil {
+        return fmt.Errorf("failed to update trips [%s]", uErr)
+      }
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
+  }
+
+  return nil
+}
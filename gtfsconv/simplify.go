@@ -0,0 +1,200 @@
+package gtfsconv
+
+import (
+  "container/heap"
+  "math"
+)
+
+// shapeSimplifier Type Helper: simplification (and quantization) of shape
+// points, for geometry tables and exports (source "shapes" is untouched).
+type shapeSimplifier struct {
+  tolerance float64 // in meters (0 = no simplification)
+  method    string  // "dp" (douglas-peucker) or "vw" (visvalingam-whyatt)
+  precision int     // coordinate decimals (0 = full precision)
+}
+
+// newShapeSimplifier Helper: shapeSimplifier from Options.
+func newShapeSimplifier(opt Options) shapeSimplifier {
+  return shapeSimplifier{
+    tolerance: opt.Simplify,
+    method:    opt.SimplifyMethod,
+    precision: opt.Precision,
+  }
+}
+
+// apply simplifies and quantizes [lon, lat] points (keeping the first
+// and last points), returning new points.
+func (ss shapeSimplifier) apply(points [][2]float64) [][2]float64 {
+  if len(points) > 2 && ss.tolerance > 0 {
+    var keep []bool
+    switch ss.method {
+      case "vw": keep = simplifyVW(toPlanar(points), ss.tolerance)
+      default: keep = simplifyDP(toPlanar(points), ss.tolerance)
+    }
+
+    var simple [][2]float64
+    for i, p := range points {
+      if keep[i] {
+        simple = append(simple, p)
+      }
+    }
+    points = simple
+  }
+
+  if ss.precision <= 0 {
+    return points
+  }
+
+  // quantize, and drop repeated points (at this precision)
+  var quant [][2]float64
+  for i, p := range points {
+    q := [2]float64{ss.round(p[0]), ss.round(p[1])}
+    if n := len(quant); n > 0 && quant[n-1] == q && i < len(points)-1 {
+      continue
+    }
+    quant = append(quant, q)
+  }
+  return quant
+}
+
+// round quantizes a coordinate to precision (if set).
+func (ss shapeSimplifier) round(v float64) float64 {
+  if ss.precision <= 0 {
+    return v
+  }
+  p := math.Pow(10, float64(ss.precision))
+  return math.Round(v * p) / p
+}
+
+// toPlanar Helper: Local planar coordinates (in meters) of [lon, lat]
+// points (equirectangular, around first point).
+func toPlanar(points [][2]float64) [][2]float64 {
+  ky := earthRadius * math.Pi / 180
+  kx := ky * math.Cos(points[0][1] * math.Pi / 180)
+
+  xy := make([][2]float64, len(points))
+  for i, p := range points {
+    xy[i] = [2]float64{p[0] * kx, p[1] * ky}
+  }
+  return xy
+}
+
+// simplifyDP Helper: Douglas-Peucker simplification, returns points to
+// keep (every removed point is within tolerance of the simplified line).
+func simplifyDP(xy [][2]float64, tolerance float64) []bool {
+  keep := make([]bool, len(xy))
+  keep[0], keep[len(xy)-1] = true, true
+
+  // iterate over ranges (instead of recursion, for long shapes)
+  stack := [][2]int{{0, len(xy) - 1}}
+  for len(stack) > 0 {
+    r := stack[len(stack)-1]
+    stack = stack[:len(stack)-1]
+
+    // find farthest point from segment
+    maxDist, maxIdx := 0.0, -1
+    for i := r[0] + 1; i < r[1]; i++ {
+      if d := segmentDistance(xy[i], xy[r[0]], xy[r[1]]); d > maxDist {
+        maxDist, maxIdx = d, i
+      }
+    }
+
+    if maxIdx >= 0 && maxDist > tolerance {
+      keep[maxIdx] = true
+      stack = append(stack, [2]int{r[0], maxIdx}, [2]int{maxIdx, r[1]})
+    }
+  }
+
+  return keep
+}
+
+// segmentDistance Helper: Distance from planar point p to segment a-b.
+func segmentDistance(p, a, b [2]float64) float64 {
+  dx, dy := b[0] - a[0], b[1] - a[1]
+  t := 0.0
+  if l := dx*dx + dy*dy; l > 0 {
+    t = math.Max(0, math.Min(1, ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / l))
+  }
+  return math.Hypot(a[0] + t*dx - p[0], a[1] + t*dy - p[1])
+}
+
+// vwPoint Type Helper: point (with effective area) for simplifyVW.
+type vwPoint struct {
+  idx         int
+  prev, next  int
+  area        float64
+  heapIdx     int
+}
+
+// vwHeap Type Helper: min-heap of vwPoint by area (container/heap).
+type vwHeap []*vwPoint
+
+func (h vwHeap) Len() int { return len(h) }
+func (h vwHeap) Less(i, j int) bool { return h[i].area < h[j].area }
+func (h vwHeap) Swap(i, j int) {
+  h[i], h[j] = h[j], h[i]
+  h[i].heapIdx, h[j].heapIdx = i, j
+}
+func (h *vwHeap) Push(x interface{}) {
+  p := x.(*vwPoint)
+  p.heapIdx = len(*h)
+  *h = append(*h, p)
+}
+func (h *vwHeap) Pop() interface{} {
+  old := *h
+  p := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return p
+}
+
+// simplifyVW Helper: Visvalingam-Whyatt simplification, returns points to
+// keep (removing points with effective area below tolerance², in m²).
+func simplifyVW(xy [][2]float64, tolerance float64) []bool {
+  n := len(xy)
+  keep := make([]bool, n)
+  for i := range keep {
+    keep[i] = true
+  }
+
+  // triangle area of point, with its neighbors
+  area := func(p *vwPoint) float64 {
+    a, b, c := xy[p.prev], xy[p.idx], xy[p.next]
+    return math.Abs((b[0]-a[0])*(c[1]-a[1]) - (c[0]-a[0])*(b[1]-a[1])) / 2
+  }
+
+  points := make([]*vwPoint, n)
+  h := &vwHeap{}
+  for i := 1; i < n-1; i++ {
+    points[i] = &vwPoint{idx: i, prev: i - 1, next: i + 1}
+    points[i].area = area(points[i])
+    heap.Push(h, points[i])
+  }
+
+  // remove smallest areas, until all are above threshold
+  threshold := tolerance * tolerance
+  maxArea := 0.0
+  for h.Len() > 0 {
+    p := heap.Pop(h).(*vwPoint)
+
+    // ensure areas never decrease (as points are removed)
+    maxArea = math.Max(maxArea, p.area)
+    if maxArea >= threshold {
+      break
+    }
+    keep[p.idx] = false
+
+    // relink, and update neighbors' areas
+    if prev := points[p.prev]; prev != nil {
+      prev.next = p.next
+      prev.area = math.Max(area(prev), maxArea)
+      heap.Fix(h, prev.heapIdx)
+    }
+    if next := points[p.next]; next != nil {
+      next.prev = p.prev
+      next.area = math.Max(area(next), maxArea)
+      heap.Fix(h, next.heapIdx)
+    }
+  }
+
+  return keep
+}
@@ -2,12 +2,15 @@ package gtfsconv
 
 import (
   "fmt"
+  "sync"
   "database/sql"
 )
 
 // buildSpatialite enables Spatialite SQLite extension,
 // and creates additional spatial-enhanced tables.
-func buildSpatialite(db *sql.DB) error {
+// Shapes are simplified (and quantized) with simp, and path geometries
+// of "routes_geo" are generated across workers.
+func buildSpatialite(db *sql.DB, workers int, simp shapeSimplifier) error {
 
   // sanity check that spatialite is loaded
   if hasDBSpatialite(db) == false {
@@ -36,15 +39,53 @@ func buildSpatialite(db *sql.DB) error {
   }
 
   if hasDBTable(db, "shapes") { // only build, if "shapes" table exists
-    if shapesErr := buildSpatialShapes(db); shapesErr != nil {
+    if shapesErr := buildSpatialShapes(db, simp); shapesErr != nil {
       return fmt.Errorf("buildSpatialShapes() %s", shapesErr)
     }
 
-    if routesErr := buildSpatialRoutes(db); routesErr != nil {
+    if routesErr := buildSpatialRoutes(db, workers); routesErr != nil {
       return fmt.Errorf("buildSpatialRoutes() %s", routesErr)
     }
   }
 
+  if indexErr := buildSpatialIndexes(db); indexErr != nil {
+    return fmt.Errorf("buildSpatialIndexes() %s", indexErr)
+  }
+
+  return nil
+}
+
+// buildSpatialIndexes Helper: Create spatialite spatial index
+// on every geometry column (that does not have one yet).
+func buildSpatialIndexes(db *sql.DB) error {
+
+  // collect geometry columns without spatial index
+  cols, cErr := db.Query("select f_table_name, f_geometry_column " +
+    "from geometry_columns where spatial_index_enabled = 0;")
+  if cErr != nil {
+    return fmt.Errorf("failed to query geometry_columns [%s]", cErr)
+  }
+
+  var geoCols [][2]string
+  var table, col string
+  for cols.Next() {
+    if sErr := cols.Scan(&table, &col); sErr != nil {
+      cols.Close()
+      return fmt.Errorf("failed to scan geometry_columns [%s]", sErr)
+    }
+    geoCols = append(geoCols, [2]string{table, col})
+  }
+  cols.Close()
+
+  for _, gc := range geoCols {
+    var ok int // 1 if success, otherwise 0
+    if ciErr := db.QueryRow("select CreateSpatialIndex(?, ?);",
+      gc[0], gc[1]).Scan(&ok); ciErr != nil || ok != 1 {
+      return fmt.Errorf("failed to create spatial index on %s.%s [%v]",
+        gc[0], gc[1], ciErr)
+    }
+  }
+
   return nil
 }
 
@@ -111,9 +152,10 @@ func buildSpatialStops(db *sql.DB) error {
   return nil
 }
 
-// buildSpatialShapes Helper: Build "shapes_geo" spatialite table.
+// buildSpatialShapes Helper: Build "shapes_geo" spatialite table,
+// with shapes simplified (and quantized) with simp.
 // note: "shapes" table must exist in db!
-func buildSpatialShapes(db *sql.DB) error {
+func buildSpatialShapes(db *sql.DB, simp shapeSimplifier) error {
 
   // count current number of shapes, for sanity checking,
   numShapes, nsErr := countDBTable(db, "distinct(shape_id)", "shapes")
@@ -149,15 +191,27 @@ func buildSpatialShapes(db *sql.DB) error {
   }
 
   // process each existing "shapes.shape_id" into "shapes_geo"
-  if _, iErr := db.Exec("insert into shapes_geo " +
-                     "select shape_id, geomfromtext(" +
-                       "'LINESTRING(' || " +
-                         "group_concat(shape_pt_lon || ' ' || shape_pt_lat) " +
-                       " || ')', " +
-                     "4326) as geom " +
-                     "from shapes group by shape_id;");
-    iErr != nil {
-    return fmt.Errorf("failed to insert rows into `shapes_geo` [%s]", iErr)
+  shapes, sErr := queryShapes(db)
+  if sErr != nil {
+    return fmt.Errorf("queryShapes() %s", sErr)
+  }
+
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for _, s := range shapes {
+    if _, iErr := tx.Exec("insert into shapes_geo (shape_id, geom) " +
+      "values (?, geomfromwkb(?, 4326));",
+      s.id, wkbLineString(simp.apply(s.points))); iErr != nil {
+      return fmt.Errorf("failed to insert rows into `shapes_geo` [%s]", iErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
   }
 
   // add unique index
@@ -179,13 +233,32 @@ func buildSpatialShapes(db *sql.DB) error {
   return nil
 }
 
+// routePath Type Helper: route:direction geometries, for generating
+// path geometry (shape cut at each stop), see buildSpatialRoutes.
+type routePath struct {
+  rowid     int64
+  geom      []byte  // union of shapes
+  stopgeom  []byte  // union of stops
+  pathgeom  []byte  // result (or nil, if failed)
+  err       string  // reason for failure (or empty)
+}
+
 // buildSpatialRoutes Helper: Build "routes_geo" spatialite table.
+// Shape and stop unions of every route:direction are computed in bulk,
+// and path geometries (shapes cut at stops) across a pool of workers.
+// Per-route failures are recorded in "geom_error" column (not fatal).
 // note: "shapes" table must exist in db!
-func buildSpatialRoutes(db *sql.DB) error {
+func buildSpatialRoutes(db *sql.DB, workers int) error {
+
+  // optional "trips.direction_id" column (or empty)
+  dir := "''"
+  if hasDBTableCol(db, "trips", "direction_id") {
+    dir = "direction_id"
+  }
 
   // count current number of routes, for sanity checking,
-  numRoutes, nsErr := countDBTable(db,
-    "distinct(route_id||direction_id)", "trips")
+  numRoutes, nsErr := countDBTable(db, "*",
+    "(select distinct route_id, "+dir+" from trips)")
   if nsErr != nil {
     return fmt.Errorf("countDBTable() %s", nsErr)
   }
@@ -213,7 +286,7 @@ func buildSpatialRoutes(db *sql.DB) error {
   // create new "routes_geo" table
   // with spatialite geometry column
   if _, cErr := db.Exec(`
-  create table routes_geo (route_id text, direction_id text);
+  create table routes_geo (route_id text, direction_id text, geom_error text);
   select AddGeometryColumn('routes_geo', 'geom', 4326, 'MULTILINESTRING'),
     AddGeometryColumn('routes_geo', 'stopgeom', 4326, 'MULTIPOINT'),
     AddGeometryColumn('routes_geo', 'pathgeom', 4326, 'MULTILINESTRING');`);
@@ -221,54 +294,84 @@ func buildSpatialRoutes(db *sql.DB) error {
     return fmt.Errorf("failed to create table `routes_geo` [%s]", cErr)
   }
 
-  // select all distinct route:direction
-  rts, rErr := db.Query("select distinct route_id, direction_id from trips;")
-  if rErr != nil {
-    return fmt.Errorf("failed to query distinct trips [%s]", rErr)
+  // union all shapes, and all stops, of each route:direction (in bulk)
+  if _, uErr := db.Exec(fmt.Sprintf(`
+    drop table if exists temp.route_shapes_geo;
+    create temp table route_shapes_geo as
+    select route_id, direction_id,
+      castToMulti(linemerge(st_union(geom))) as geom
+    from (select distinct t.route_id, t.%[1]s as direction_id,
+        t.shape_id, sg.geom
+      from trips t join shapes_geo sg on sg.shape_id = t.shape_id)
+    group by route_id, direction_id;
+
+    drop table if exists temp.route_stops_geo;
+    create temp table route_stops_geo as
+    select route_id, direction_id, castToMulti(st_union(geom)) as geom
+    from (select distinct t.route_id, t.%[1]s as direction_id,
+        st.stop_id, sg.geom
+      from trips t
+        join stop_times st on st.trip_id = t.trip_id
+        join stops_geo sg on sg.stop_id = st.stop_id)
+    group by route_id, direction_id;
+
+    insert into routes_geo (route_id, direction_id, geom, stopgeom)
+    select r.route_id, r.direction_id, sh.geom, sp.geom
+    from (select distinct route_id, %[1]s as direction_id from trips) r
+      left join temp.route_shapes_geo sh
+        on sh.route_id = r.route_id and sh.direction_id = r.direction_id
+      left join temp.route_stops_geo sp
+        on sp.route_id = r.route_id and sp.direction_id = r.direction_id;
+
+    drop table temp.route_shapes_geo;
+    drop table temp.route_stops_geo;`, dir)); uErr != nil {
+    return fmt.Errorf("failed to insert rows into `routes_geo` [%s]", uErr)
   }
 
-  var routes [][2]string
-  var rid, did string
-  for rts.Next() {
-    if sErr := rts.Scan(&rid, &did); sErr != nil {
-      return fmt.Errorf("failed to scan routes [%s]", sErr)
+  // collect route:direction geometries, for path geometry
+  rows, qErr := db.Query("select rowid, geom, stopgeom from routes_geo;")
+  if qErr != nil {
+    return fmt.Errorf("failed to query routes_geo [%s]", qErr)
+  }
+
+  var paths []routePath
+  for rows.Next() {
+    var p routePath
+    if sErr := rows.Scan(&p.rowid, &p.geom, &p.stopgeom); sErr != nil {
+      rows.Close()
+      return fmt.Errorf("failed to scan routes_geo [%s]", sErr)
     }
-    routes = append(routes, [2]string{rid, did})
-  }
-  rts.Close()
-
-  for _, rt := range routes {
-    rid = rt[0]
-    did = rt[1]
-
-    // generate and insert new routes_geo rows
-    if _, irErr := db.Exec(fmt.Sprintf(`
-    insert into routes_geo
-      (route_id, direction_id, geom, stopgeom, pathgeom)
-
-    select
-      '%s', '%s',
-      castToMulti(SHAPES.geom),
-      castToMulti(STOPS.geom),
-      castToMulti(st_linescutatnodes(
-        st_linemerge(snap(SHAPES.geom, STOPS.geom, 0.0005)), STOPS.geom))
-
-    from
-      (select linemerge(st_union(ts.geom)) as geom from
-        (select distinct(t.shape_id), sg.geom as geom
-        from trips t left join shapes_geo sg on t.shape_id = sg.shape_id
-        where t.route_id = '%s' and t.direction_id = '%s') ts) SHAPES
-
-      left join
-      (select st_union(ts.geom) as geom from
-        (select distinct(sg.stop_id), sg.geom as geom
-        from trips t
-          left join stop_times st on t.trip_id = st.trip_id
-          left join stops_geo sg on st.stop_id = sg.stop_id
-        where t.route_id = '%s' and t.direction_id = '%s') ts) STOPS
-      on 1=1;`, rid, did, rid, did, rid, did)); irErr != nil {
-      return fmt.Errorf("failed to generate new row [%s]", irErr)
+    paths = append(paths, p)
+  }
+  rows.Close()
+
+  // generate path geometries, across a pool of workers
+  if pErr := buildSpatialRoutePaths(db, paths, workers); pErr != nil {
+    return fmt.Errorf("buildSpatialRoutePaths() %s", pErr)
+  }
+
+  // update path geometries (or failure reasons)
+  tx, bErr := db.Begin()
+  if bErr != nil {
+    return fmt.Errorf("failed to begin transaction [%s]", bErr)
+  }
+  defer tx.Rollback()
+
+  for _, p := range paths {
+    var reason interface{} // null, if no failure
+    if p.err != "" {
+      reason = p.err
     }
+
+    if _, uErr := tx.Exec("update routes_geo set pathgeom = ?, " +
+      "geom_error = ? where rowid = ?;", p.pathgeom, reason, p.rowid);
+      uErr != nil {
+      return fmt.Errorf("failed to update routes_geo [%s]", uErr)
+    }
+  }
+
+  if cErr := tx.Commit(); cErr != nil {
+    return fmt.Errorf("failed to commit transaction [%s]", cErr)
   }
 
   // add unique index
@@ -289,3 +392,56 @@ func buildSpatialRoutes(db *sql.DB) error {
 
   return nil
 }
+
+// buildSpatialRoutePaths Helper: Generate path geometry (shapes snapped,
+// and cut at stops) of each routePath, across a pool of workers.
+// Each worker uses its own (empty) in-memory connection with spatialite,
+// since geometries are only passed in as bound parameters.
+func buildSpatialRoutePaths(db *sql.DB, paths []routePath,
+  workers int) error {
+
+  if workers < 1 {
+    workers = 1
+  }
+
+  // open pool of in-memory connections (same driver, and extensions)
+  pool := openMemoryDB(db)
+  defer pool.Close()
+  pool.SetMaxOpenConns(workers)
+  pool.SetMaxIdleConns(workers)
+  if pErr := pool.Ping(); pErr != nil {
+    return fmt.Errorf("pool.Ping() %s", pErr)
+  }
+
+  jobs := make(chan *routePath)
+  var wg sync.WaitGroup
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for p := range jobs {
+        if qErr := pool.QueryRow(`
+          select castToMulti(st_linescutatnodes(
+            st_linemerge(snap(?1, ?2, 0.0005)), ?2));`,
+          p.geom, p.stopgeom).Scan(&p.pathgeom); qErr != nil {
+          p.err = fmt.Sprintf("failed to generate path [%s]", qErr)
+        } else if p.pathgeom == nil {
+          p.err = "failed to generate path (invalid geometry)"
+        }
+      }
+    }()
+  }
+
+  for i := range paths {
+    p := &paths[i]
+    switch {
+      case p.geom == nil: p.err = "missing shape geometry"
+      case p.stopgeom == nil: p.err = "missing stop geometry"
+      default: jobs <- p
+    }
+  }
+  close(jobs)
+  wg.Wait()
+
+  return nil
+}
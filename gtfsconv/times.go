@@ -0,0 +1,132 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// importTimeColumns lists GTFS time columns (per table) that are
+// imported along with a derived "seconds since midnight" column.
+var importTimeColumns = map[string][][2]string{
+  "stop_times":   {{"arrival_time", "arrival_secs"},
+                   {"departure_time", "departure_secs"}},
+  "frequencies":  {{"start_time", "start_secs"},
+                   {"end_time", "end_secs"}},
+}
+
+// parseGTFSTime Helper: Parse GTFS "H:MM:SS" time into seconds since
+// midnight (i.e., "noon minus 12h") of the service day.
+// note: hours may be unpadded (e.g., "7:05:00"), or past 24 for
+//       trips running over midnight (e.g., "25:10:00").
+func parseGTFSTime(t string) (int, error) {
+  parts := strings.Split(t, ":")
+  if len(parts) != 3 {
+    return 0, fmt.Errorf("expected H:MM:SS")
+  }
+
+  var hms [3]int
+  for i, p := range parts {
+
+    // hours can be any length, minutes/seconds must be padded
+    if p == "" || (i > 0 && len(p) != 2) {
+      return 0, fmt.Errorf("expected H:MM:SS")
+    }
+
+    // only allow plain digits (no signs, spaces)
+    for _, c := range p {
+      if c < '0' || c > '9' {
+        return 0, fmt.Errorf("expected digits")
+      }
+    }
+
+    hms[i], _ = strconv.Atoi(p)
+    if i > 0 && hms[i] > 59 {
+      return 0, fmt.Errorf("minutes/seconds out of range")
+    }
+  }
+
+  return hms[0]*3600 + hms[1]*60 + hms[2], nil
+}
+
+// ParseClock parses a "H:MM" or "H:MM:SS" time of day into seconds since
+// midnight (hours may be past 24, as in GTFS times).
+func ParseClock(t string) (int, error) {
+  if strings.Count(t, ":") == 1 {
+    t += ":00"
+  }
+  return parseGTFSTime(t)
+}
+
+// FormatClock formats seconds since midnight as a GTFS "HH:MM:SS" time
+// (hours may be past 24, see ParseClock).
+func FormatClock(secs int) string {
+  return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+}
+
+// sqlGTFSTime Helper: SQL expression formatting a "seconds since
+// midnight" column into GTFS "HH:MM:SS" time (see FormatClock).
+// note: null stays null (printf would format it as zero).
+func sqlGTFSTime(col string) string {
+  return fmt.Sprintf("case when (%[1]s) is null then null else " +
+    "printf('%%02d:%%02d:%%02d', (%[1]s)/3600, (%[1]s)%%3600/60, (%[1]s)%%60) " +
+    "end", col)
+}
+
+// timePeriod Type Helper: named time-of-day period, from start (inclusive)
+// until end (exclusive), as seconds since midnight (see parsePeriods).
+type timePeriod struct {
+  name        string
+  start, end  int
+}
+
+// parsePeriods Helper: Parse time-of-day periods, formatted as
+// "name=start-end,..." with hours (e.g., "am=6-9", "pm=15:30-18:30").
+func parsePeriods(s string) ([]timePeriod, error) {
+  var periods []timePeriod
+  for _, p := range strings.Split(s, ",") {
+    if p = strings.TrimSpace(p); p == "" {
+      continue
+    }
+
+    eq := strings.Index(p, "=")
+    dash := strings.LastIndex(p, "-")
+    if eq < 1 || dash < eq {
+      return nil, fmt.Errorf("invalid period %q, expected name=start-end", p)
+    }
+
+    var bounds [2]int
+    for i, h := range [...]string{p[eq+1:dash], p[dash+1:]} {
+      switch strings.Count(h, ":") { // allow "H", "H:MM", or "H:MM:SS"
+        case 0: h += ":00:00"
+        case 1: h += ":00"
+      }
+      secs, tErr := parseGTFSTime(h)
+      if tErr != nil {
+        return nil, fmt.Errorf("invalid period %q [%s]", p, tErr)
+      }
+      bounds[i] = secs
+    }
+    if bounds[0] >= bounds[1] {
+      return nil, fmt.Errorf("invalid period %q, start is not before end", p)
+    }
+
+    periods = append(periods, timePeriod{p[:eq], bounds[0], bounds[1]})
+  }
+
+  return periods, nil
+}
+
+// periodOf Helper: Name of the (first) period including secs, or empty.
+// note: times past midnight (e.g., "25:10:00") also match periods of the
+//       next day (e.g., "1:10:00"), unless a period covers them directly.
+func periodOf(periods []timePeriod, secs int) string {
+  for _, day := range [...]int{secs, secs % 86400} {
+    for _, p := range periods {
+      if day >= p.start && day < p.end {
+        return p.name
+      }
+    }
+  }
+  return ""
+}
@@ -0,0 +1,144 @@
+package gtfsconv
+
+import (
+  "bytes"
+  "fmt"
+  "reflect"
+  "strings"
+  "testing"
+  "archive/zip"
+  "database/sql"
+)
+
+func TestParseGTFSTime(t *testing.T) {
+  tests := []struct {
+    in    string
+    want  int
+    valid bool
+  }{
+    {"08:05:09", 29109, true},
+    {"7:05:00", 25500, true},
+    {"00:00:00", 0, true},
+    {"25:10:00", 90600, true},
+    {"123:00:00", 442800, true},
+    {"8:05", 0, false},
+    {"8:5:00", 0, false},
+    {"08:60:00", 0, false},
+    {"08:00:60", 0, false},
+    {"-1:00:00", 0, false},
+    {" 8:00:00", 0, false},
+    {"", 0, false},
+  }
+
+  for _, tc := range tests {
+    got, pErr := parseGTFSTime(tc.in)
+    if (pErr == nil) != tc.valid || got != tc.want {
+      t.Errorf("parseGTFSTime(%q) = %d, %v, want %d (valid %t)",
+        tc.in, got, pErr, tc.want, tc.valid)
+    }
+  }
+}
+
+func TestImportTimeColumns(t *testing.T) {
+  var buf bytes.Buffer
+  zw := zip.NewWriter(&buf)
+  fw, _ := zw.Create("stop_times.txt")
+  fw.Write([]byte("trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+    "T1,7:05:00,07:06:00,S1,1\n" +
+    "T1,25:10:00,,S2,2\n" +
+    "T1,9:2x:00,09:30:00,S3,3\n"))
+  zw.Close()
+  gtfs, zErr := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+  if zErr != nil {
+    t.Fatalf("zip.NewReader() %s", zErr)
+  }
+
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1) // each connection is its own db
+  defer db.Close()
+
+  if iErr := importGTFS(db, gtfs, defaultOptions); iErr != nil {
+    t.Fatalf("importGTFS() %s", iErr)
+  }
+
+  // derived "seconds" columns (null if missing, or invalid)
+  rows, qErr := db.Query("select arrival_time, " +
+    "coalesce(arrival_secs, -1), coalesce(departure_secs, -1) " +
+    "from stop_times order by stop_sequence;")
+  if qErr != nil {
+    t.Fatalf("db.Query() %s", qErr)
+  }
+  defer rows.Close()
+
+  var got []string
+  for rows.Next() {
+    var text string
+    var arr, dep int
+    if sErr := rows.Scan(&text, &arr, &dep); sErr != nil {
+      t.Fatalf("rows.Scan() %s", sErr)
+    }
+    got = append(got, fmt.Sprintf("%s %d %d", text, arr, dep))
+  }
+  want := []string{"7:05:00 25500 25560", "25:10:00 90600 -1",
+    "9:2x:00 -1 34200"}
+  if reflect.DeepEqual(got, want) == false {
+    t.Errorf("stop_times = %q, want %q", got, want)
+  }
+
+  // invalid time is logged (row is still imported)
+  var line int
+  var reason string
+  if qErr := db.QueryRow("select line, reason from gtfs_import_errors;").
+    Scan(&line, &reason); qErr != nil {
+    t.Fatalf("select gtfs_import_errors %s", qErr)
+  }
+  if line != 4 || strings.Contains(reason, "arrival_time") == false {
+    t.Errorf("logged error = line %d %q, want line 4 arrival_time",
+      line, reason)
+  }
+}
+
+func TestParseClock(t *testing.T) {
+  tests := []struct {
+    in    string
+    want  int
+    valid bool
+  }{
+    {"7:50", 28200, true},
+    {"07:50:30", 28230, true},
+    {"24:30", 88200, true},
+    {"7", 0, false},
+    {"7:5", 0, false},
+    {"7:50:", 0, false},
+    {"now", 0, false},
+  }
+
+  for _, tc := range tests {
+    got, pErr := ParseClock(tc.in)
+    if (pErr == nil) != tc.valid || got != tc.want {
+      t.Errorf("ParseClock(%q) = %d, %v, want %d (valid %t)",
+        tc.in, got, pErr, tc.want, tc.valid)
+    }
+  }
+}
+
+func TestFormatClock(t *testing.T) {
+  tests := []struct {
+    in   int
+    want string
+  }{
+    {0, "00:00:00"},
+    {29109, "08:05:09"},
+    {90600, "25:10:00"},
+    {442800, "123:00:00"},
+  }
+
+  for _, tc := range tests {
+    if got := FormatClock(tc.in); got != tc.want {
+      t.Errorf("FormatClock(%d) = %q, want %q", tc.in, got, tc.want)
+    }
+  }
+}
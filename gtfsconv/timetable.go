@@ -0,0 +1,425 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "database/sql"
+)
+
+// ttStop Type Helper: stop, of Timetable.
+type ttStop struct {
+  id        string
+  name      string
+  station   string // parent_station (or empty)
+  lat, lon  float64
+  located   bool   // with coordinates
+}
+
+// ttTrip Type Helper: trip run (of a service date), of Timetable.
+type ttTrip struct {
+  id          string
+  headsign    string
+  serviceDate string // previous date, for trips running past midnight
+  arr, dep    []int  // seconds since midnight (of Timetable date)
+  noBoard     []bool // pickup_type = 1
+  noAlight    []bool // drop_off_type = 1
+}
+
+// ttRoute Type Helper: RAPTOR route, trips with the same route, and
+// ordered stops, that never overtake each other (sorted by departure).
+type ttRoute struct {
+  routeID string
+  name    string
+  stops   []int
+  trips   []*ttTrip
+}
+
+// ttFootpath Type Helper: walking transfer, of Timetable.
+type ttFootpath struct {
+  to        int
+  secs      int     // min_transfer_time (or -1, by distance)
+  distance  float64 // in meters
+}
+
+// Timetable is an in-memory timetable of a service date (with trips of
+// the previous service date, running past midnight), for journey planning
+// (see LoadTimetable, and Plan).
+type Timetable struct {
+  Date        string // service date (YYYYMMDD)
+  stops       []ttStop
+  stopIdx     map[string]int
+  children    map[string][]int // child stops, of each parent station
+  routes      []*ttRoute
+  stopRoutes  [][][2]int       // [route, position] of routes at each stop
+  footpaths   [][]ttFootpath   // walking transfers, from each stop
+  minTransfer []int            // min transfer time at each stop (seconds)
+}
+
+// LoadTimetable loads trips (with each frequency-based run) active on a
+// service date (YYYYMMDD), or running past midnight from the previous
+// service date, with "transfers" (and "transfers_generated", if exists),
+// and walking transfers within parent stations, into a Timetable.
+func LoadTimetable(db *sql.DB, date string) (*Timetable, error) {
+  day, dErr := time.Parse("20060102", date)
+  if dErr != nil {
+    return nil, fmt.Errorf("invalid date %q, expected YYYYMMDD", date)
+  }
+  prevDate := day.AddDate(0, 0, -1).Format("20060102")
+
+  // sanity checks (service dates, derived "seconds" columns)
+  if hasDBTable(db, "service_dates") == false {
+    return nil, fmt.Errorf("missing service_dates table")
+  }
+  if rErr := requireSecsColumns(db); rErr != nil {
+    return nil, rErr
+  }
+
+  tt := &Timetable{Date: date, stopIdx: map[string]int{},
+    children: map[string][]int{}}
+  if sErr := tt.loadStops(db); sErr != nil {
+    return nil, fmt.Errorf("loadStops() %s", sErr)
+  }
+
+  // active services, of date (no shift) and previous date (shifted)
+  shifts := map[string]map[string]int{}
+  rows, qErr := db.Query("select date, service_id from service_dates " +
+    "where date in (?, ?);", date, prevDate)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select service_dates [%s]", qErr)
+  }
+  for rows.Next() {
+    var d, service string
+    if sErr := rows.Scan(&d, &service); sErr != nil {
+      rows.Close()
+      return nil, fmt.Errorf("failed to scan service_dates [%s]", sErr)
+    }
+    if shifts[service] == nil {
+      shifts[service] = map[string]int{}
+    }
+    shifts[service][d] = 0
+    if d == prevDate {
+      shifts[service][d] = -86400
+    }
+  }
+  rows.Close()
+
+  // route names (short name, or long name)
+  names := map[string]string{}
+  if hasDBTable(db, "routes") {
+    rows, qErr := db.Query(fmt.Sprintf(`
+      select r.route_id, coalesce(nullif(%s, ''), %s) from routes r;`,
+      optDBTableCol(db, "r", "routes", "route_short_name"),
+      optDBTableCol(db, "r", "routes", "route_long_name")))
+    if qErr != nil {
+      return nil, fmt.Errorf("failed to select routes [%s]", qErr)
+    }
+    for rows.Next() {
+      var id, name string
+      if sErr := rows.Scan(&id, &name); sErr != nil {
+        rows.Close()
+        return nil, fmt.Errorf("failed to scan routes [%s]", sErr)
+      }
+      names[id] = name
+    }
+    rows.Close()
+  }
+
+  freqs, fErr := queryFrequencyRuns(db)
+  if fErr != nil {
+    return nil, fmt.Errorf("queryFrequencyRuns() %s", fErr)
+  }
+
+  // retrieve stop times of active trips
+  rows, qErr = db.Query(fmt.Sprintf(`
+    select t.trip_id, t.route_id, t.service_id, %s, st.stop_id,
+      coalesce(st.arrival_secs, st.departure_secs),
+      coalesce(st.departure_secs, st.arrival_secs), %s, %s
+    from stop_times st join trips t on t.trip_id = st.trip_id
+    where t.service_id in
+        (select service_id from service_dates where date in (?, ?))
+      and coalesce(st.arrival_secs, st.departure_secs) is not null
+    order by st.trip_id, cast(st.stop_sequence as int);`,
+    optDBTableCol(db, "t", "trips", "trip_headsign"),
+    optDBTableCol(db, "st", "stop_times", "pickup_type"),
+    optDBTableCol(db, "st", "stop_times", "drop_off_type")), date, prevDate)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select stop_times [%s]", qErr)
+  }
+
+  // group trip runs by route and ordered stops (with pickup/drop-off,
+  // since a route's trips are scanned in order, for boarding/alighting)
+  byKey := map[string][]*ttTrip{}
+  keyRoute := map[string]string{}
+  keyStops := map[string][]int{}
+  var keys []string
+
+  var trip *ttTrip // current trip (template)
+  var tripRoute, tripService string
+  var tripStops []int
+  addTrip := func() {
+    if trip == nil || len(tripStops) < 2 {
+      return
+    }
+    key := tripRoute
+    for j, s := range tripStops {
+      key += fmt.Sprintf("\x00%d:%t:%t", s, trip.noBoard[j], trip.noAlight[j])
+    }
+    if _, ok := keyRoute[key]; ok == false {
+      keys = append(keys, key)
+      keyRoute[key], keyStops[key] = tripRoute, tripStops
+    }
+
+    // each run (each departure of frequency-based trips)
+    ids, starts := []string{trip.id}, []int{trip.dep[0]}
+    if fs, ok := freqs[trip.id]; ok {
+      ids, starts = nil, nil
+      for _, f := range fs {
+        for secs := f[0]; secs < f[1]; secs += f[2] {
+          ids = append(ids, trip.id + "@" + FormatClock(secs))
+          starts = append(starts, secs)
+        }
+      }
+    }
+
+    // on each active service date
+    for d, shift := range shifts[tripService] {
+      for i, id := range ids {
+        offset := starts[i] - trip.dep[0] + shift
+        if trip.arr[len(trip.arr)-1] + offset < 0 {
+          continue // before midnight (of date)
+        }
+
+        t := &ttTrip{id: id, headsign: trip.headsign, serviceDate: d,
+          noBoard: trip.noBoard, noAlight: trip.noAlight,
+          arr: make([]int, len(trip.arr)), dep: make([]int, len(trip.dep))}
+        for j := range trip.arr {
+          t.arr[j], t.dep[j] = trip.arr[j] + offset, trip.dep[j] + offset
+        }
+        byKey[key] = append(byKey[key], t)
+      }
+    }
+  }
+
+  for rows.Next() {
+    var tripID, routeID, service, headsign, stopID, pickup, dropOff string
+    var arr, dep int
+    if sErr := rows.Scan(&tripID, &routeID, &service, &headsign, &stopID,
+      &arr, &dep, &pickup, &dropOff); sErr != nil {
+      rows.Close()
+      return nil, fmt.Errorf("failed to scan stop_times [%s]", sErr)
+    }
+
+    if trip == nil || trip.id != tripID { // next trip
+      addTrip()
+      trip = &ttTrip{id: tripID, headsign: headsign}
+      tripRoute, tripService, tripStops = routeID, service, nil
+    }
+
+    s, ok := tt.stopIdx[stopID]
+    if ok == false {
+      continue // unknown stop
+    }
+    tripStops = append(tripStops, s)
+    trip.arr = append(trip.arr, arr)
+    trip.dep = append(trip.dep, dep)
+    trip.noBoard = append(trip.noBoard, strings.TrimSpace(pickup) == "1")
+    trip.noAlight = append(trip.noAlight, strings.TrimSpace(dropOff) == "1")
+  }
+  addTrip()
+  rows.Close()
+
+  // split into routes, of trips never overtaking each other
+  tt.stopRoutes = make([][][2]int, len(tt.stops))
+  for _, key := range keys {
+    trips := byKey[key]
+    sort.Slice(trips, func(i, j int) bool {
+      a, b := trips[i], trips[j]
+      return a.dep[0] < b.dep[0] || (a.dep[0] == b.dep[0] &&
+        (a.serviceDate < b.serviceDate ||
+          (a.serviceDate == b.serviceDate && a.id < b.id)))
+    })
+
+    var routes []*ttRoute
+    for _, t := range trips {
+      var route *ttRoute
+      for _, r := range routes {
+        last := r.trips[len(r.trips)-1]
+        overtakes := false
+        for j := range t.arr {
+          if t.arr[j] < last.arr[j] || t.dep[j] < last.dep[j] {
+            overtakes = true
+            break
+          }
+        }
+        if overtakes == false {
+          route = r
+          break
+        }
+      }
+      if route == nil {
+        route = &ttRoute{routeID: keyRoute[key],
+          name: names[keyRoute[key]], stops: keyStops[key]}
+        routes = append(routes, route)
+      }
+      route.trips = append(route.trips, t)
+    }
+
+    for _, r := range routes {
+      for pos, s := range r.stops {
+        tt.stopRoutes[s] = append(tt.stopRoutes[s], [2]int{len(tt.routes), pos})
+      }
+      tt.routes = append(tt.routes, r)
+    }
+  }
+
+  if tErr := tt.loadTransfers(db); tErr != nil {
+    return nil, fmt.Errorf("loadTransfers() %s", tErr)
+  }
+
+  return tt, nil
+}
+
+// loadStops Helper: Load all stops (with parent stations) into tt.
+func (tt *Timetable) loadStops(db *sql.DB) error {
+  rows, qErr := db.Query(fmt.Sprintf(`
+    select s.stop_id, %s, %s, cast(nullif(s.stop_lat, '') as real),
+      cast(nullif(s.stop_lon, '') as real)
+    from stops s
+    order by s.stop_id;`,
+    optDBTableCol(db, "s", "stops", "stop_name"),
+    optDBTableCol(db, "s", "stops", "parent_station")))
+  if qErr != nil {
+    return fmt.Errorf("failed to select stops [%s]", qErr)
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var s ttStop
+    var lat, lon sql.NullFloat64
+    if sErr := rows.Scan(&s.id, &s.name, &s.station, &lat, &lon);
+      sErr != nil {
+      return fmt.Errorf("failed to scan stops [%s]", sErr)
+    }
+    s.lat, s.lon, s.located = lat.Float64, lon.Float64, lat.Valid && lon.Valid
+
+    tt.stopIdx[s.id] = len(tt.stops)
+    if s.station != "" {
+      tt.children[s.station] = append(tt.children[s.station], len(tt.stops))
+    }
+    tt.stops = append(tt.stops, s)
+  }
+
+  return nil
+}
+
+// loadTransfers Helper: Load walking transfers (and min transfer times
+// at stops) from "transfers" (and "transfers_generated", if exists), and
+// between stops of the same parent station (by distance, if not set).
+func (tt *Timetable) loadTransfers(db *sql.DB) error {
+  tt.footpaths = make([][]ttFootpath, len(tt.stops))
+  tt.minTransfer = make([]int, len(tt.stops))
+  linked := map[[2]int]bool{}
+
+  // addFootpath Helper: walking transfer (once per pair of stops)
+  addFootpath := func(from, to, secs int) {
+    if linked[[2]int{from, to}] {
+      return
+    }
+    linked[[2]int{from, to}] = true
+
+    a, b := tt.stops[from], tt.stops[to]
+    fp := ttFootpath{to: to, secs: secs}
+    if a.located && b.located {
+      fp.distance = haversine(a.lat, a.lon, b.lat, b.lon)
+    }
+    tt.footpaths[from] = append(tt.footpaths[from], fp)
+  }
+
+  for _, table := range [...]string{"transfers", "transfers_generated"} {
+    if hasDBTable(db, table) == false {
+      continue
+    }
+    minTime := optDBTableCol(db, "", table, "min_transfer_time")
+
+    rows, qErr := db.Query(fmt.Sprintf(`
+      select from_stop_id, to_stop_id, coalesce(transfer_type, ''), %s
+      from %s;`, minTime, table))
+    if qErr != nil {
+      return fmt.Errorf("failed to select %s [%s]", table, qErr)
+    }
+    for rows.Next() {
+      var fromID, toID, kind, minSecs string
+      if sErr := rows.Scan(&fromID, &toID, &kind, &minSecs); sErr != nil {
+        rows.Close()
+        return fmt.Errorf("failed to scan %s [%s]", table, sErr)
+      }
+      secs, pErr := strconv.Atoi(strings.TrimSpace(minSecs))
+
+      from, fOk := tt.stopIdx[fromID]
+      to, tOk := tt.stopIdx[toID]
+      if fOk == false || tOk == false || strings.TrimSpace(kind) == "3" {
+        continue // unknown stops, or transfer not possible
+      }
+
+      switch {
+        case from == to && pErr == nil:
+          tt.minTransfer[from] = secs
+        case from != to && pErr == nil:
+          addFootpath(from, to, secs)
+        case from != to:
+          addFootpath(from, to, -1)
+      }
+    }
+    rows.Close()
+  }
+
+  // walking transfers within parent stations (by distance)
+  for _, kids := range tt.children {
+    for _, a := range kids {
+      for _, b := range kids {
+        if a != b {
+          addFootpath(a, b, -1)
+        }
+      }
+    }
+  }
+
+  return nil
+}
+
+// queryFrequencyRuns Helper: Retrieve frequencies of each trip, as
+// [start, end, headway] seconds (end after start, if over midnight).
+func queryFrequencyRuns(db *sql.DB) (map[string][][3]int, error) {
+  freqs := map[string][][3]int{}
+  if hasDBTableCol(db, "frequencies", "start_secs") == false {
+    return freqs, nil
+  }
+
+  rows, qErr := db.Query(`
+    select trip_id, start_secs,
+      case when end_secs < start_secs then end_secs + 86400
+        else end_secs end,
+      cast(headway_secs as int)
+    from frequencies
+    where start_secs is not null and end_secs is not null
+      and cast(headway_secs as int) > 0
+    order by trip_id, start_secs;`)
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to select frequencies [%s]", qErr)
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var id string
+    var f [3]int
+    if sErr := rows.Scan(&id, &f[0], &f[1], &f[2]); sErr != nil {
+      return nil, fmt.Errorf("failed to scan frequencies [%s]", sErr)
+    }
+    freqs[id] = append(freqs[id], f)
+  }
+
+  return freqs, nil
+}
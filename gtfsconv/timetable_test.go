@@ -0,0 +1,170 @@
+package gtfsconv
+
+import (
+  "database/sql"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+// timetableSchema: minimal tables (and derived columns) of LoadTimetable
+const timetableSchema = `
+  create table stops (stop_id text, stop_name text, stop_lat text,
+    stop_lon text, parent_station text);
+  create table routes (route_id text, route_short_name text,
+    route_long_name text);
+  create table trips (trip_id text, route_id text, service_id text,
+    trip_headsign text);
+  create table stop_times (trip_id text, stop_id text, stop_sequence text,
+    arrival_secs integer, departure_secs integer, pickup_type text,
+    drop_off_type text);
+  create table service_dates (service_id text, date text);
+  create table transfers (from_stop_id text, to_stop_id text,
+    transfer_type text, min_transfer_time text);
+  create table frequencies (trip_id text, start_secs integer,
+    end_secs integer, headway_secs text);`
+
+// openTestDB Helper: In-memory sqlite db (a single connection, since
+// each connection is its own db), with timetableSchema, and rows.
+func openTestDB(t *testing.T, rows string) *sql.DB {
+  t.Helper()
+  db, oErr := sql.Open("sqlite3", ":memory:")
+  if oErr != nil {
+    t.Fatalf("sql.Open() %s", oErr)
+  }
+  db.SetMaxOpenConns(1)
+  t.Cleanup(func() { db.Close() })
+
+  if _, eErr := db.Exec(timetableSchema + ";" + rows); eErr != nil {
+    t.Fatalf("db.Exec() %s", eErr)
+  }
+  return db
+}
+
+func TestLoadTimetableRoutes(t *testing.T) {
+  stops := `
+    insert into stops values ('A', 'A', '40.700', '-74.000', ''),
+      ('B', 'B', '40.710', '-74.000', ''), ('C', 'C', '40.720', '-74.000', '');
+    insert into routes values ('R', 'R', '');
+    insert into service_dates values ('WK', '20260105'), ('WK', '20260104');`
+
+  tests := []struct {
+    name  string
+    rows  string
+    want  [][]string // trip ids, of each route
+  }{
+    {
+      name: "overtaking trip is split into another route",
+      rows: `
+        insert into trips values ('T1', 'R', 'WK', ''), ('T2', 'R', 'WK', ''),
+          ('T3', 'R', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 30600, 30600, '', ''),
+          ('T2', 'A', '1', 29400, 29400, '', ''),
+          ('T2', 'B', '2', 30000, 30000, '', ''),
+          ('T3', 'A', '1', 30000, 30000, '', ''),
+          ('T3', 'B', '2', 31200, 31200, '', '');`,
+      want: [][]string{{"T1", "T3"}, {"T2"}},
+    },
+    {
+      name: "different stop sequences are different routes",
+      rows: `
+        insert into trips values ('T1', 'R', 'WK', ''), ('T2', 'R', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', ''),
+          ('T2', 'A', '1', 28800, 28800, '', ''),
+          ('T2', 'C', '2', 30000, 30000, '', '');`,
+      want: [][]string{{"T1"}, {"T2"}},
+    },
+    {
+      name: "different pickup/drop-off types are different routes",
+      rows: `
+        insert into trips values ('T1', 'R', 'WK', ''), ('T2', 'R', 'WK', '');
+        insert into stop_times values
+          ('T1', 'A', '1', 28800, 28800, '', ''),
+          ('T1', 'B', '2', 29400, 29400, '', '1'),
+          ('T2', 'A', '1', 30000, 30000, '', ''),
+          ('T2', 'B', '2', 30600, 30600, '', '');`,
+      want: [][]string{{"T1"}, {"T2"}},
+    },
+    {
+      name: "frequency-based trip runs at each departure",
+      rows: `
+        insert into trips values ('F', 'R', 'WK', '');
+        insert into stop_times values
+          ('F', 'A', '1', 0, 0, '', ''),
+          ('F', 'B', '2', 600, 600, '', '');
+        insert into frequencies values ('F', 32400, 36000, '1800');`,
+      want: [][]string{{"F@09:00:00", "F@09:30:00"}},
+    },
+    {
+      name: "previous date trips are kept only past midnight",
+      rows: `
+        insert into service_dates values ('SU', '20260104');
+        insert into trips values ('N', 'R', 'SU', ''), ('E', 'R', 'SU', '');
+        insert into stop_times values
+          ('N', 'A', '1', 88200, 88200, '', ''),
+          ('N', 'B', '2', 90000, 90000, '', ''),
+          ('E', 'A', '1', 72000, 72000, '', ''),
+          ('E', 'B', '2', 73800, 73800, '', '');`,
+      want: [][]string{{"N"}},
+    },
+  }
+
+  for _, tc := range tests {
+    t.Run(tc.name, func(t *testing.T) {
+      db := openTestDB(t, stops + tc.rows)
+      tt, lErr := LoadTimetable(db, "20260105")
+      if lErr != nil {
+        t.Fatalf("LoadTimetable() %s", lErr)
+      }
+
+      var got [][]string
+      for _, r := range tt.routes {
+        var ids []string
+        for _, trip := range r.trips {
+          ids = append(ids, trip.id)
+        }
+        got = append(got, ids)
+      }
+      if reflect.DeepEqual(got, tc.want) == false {
+        t.Errorf("routes = %v, want %v", got, tc.want)
+      }
+    })
+  }
+}
+
+func TestLoadTimetableShift(t *testing.T) {
+  db := openTestDB(t, `
+    insert into stops values ('A', 'A', '', '', ''), ('B', 'B', '', '', '');
+    insert into trips values ('N', 'R', 'SU', '');
+    insert into service_dates values ('SU', '20260104');
+    insert into stop_times values
+      ('N', 'A', '1', 88200, 88200, '', ''),
+      ('N', 'B', '2', 90000, 90000, '', '');`)
+
+  tt, lErr := LoadTimetable(db, "20260105")
+  if lErr != nil {
+    t.Fatalf("LoadTimetable() %s", lErr)
+  }
+  if len(tt.routes) != 1 || len(tt.routes[0].trips) != 1 {
+    t.Fatalf("expected a single trip, got %d routes", len(tt.routes))
+  }
+
+  trip := tt.routes[0].trips[0]
+  if trip.dep[0] != 1800 || trip.arr[1] != 3600 ||
+    trip.serviceDate != "20260104" {
+    t.Errorf("trip = dep %d, arr %d, date %s, want 1800, 3600, 20260104",
+      trip.dep[0], trip.arr[1], trip.serviceDate)
+  }
+}
+
+func TestLoadTimetableInvalidDate(t *testing.T) {
+  db := openTestDB(t, "")
+  if _, lErr := LoadTimetable(db, "2026-01-05"); lErr == nil ||
+    strings.Contains(lErr.Error(), "YYYYMMDD") == false {
+    t.Errorf("LoadTimetable() error = %v, want invalid date", lErr)
+  }
+}
@@ -2,10 +2,13 @@ package gtfsconv
 
 import (
   "os"
+  "context"
   "encoding/json"
   "fmt"
   "database/sql"
+  "database/sql/driver"
   "io/ioutil"
+  "github.com/mattn/go-sqlite3"
 )
 
 // jsony Type Helper: json-like type pattern.
@@ -112,3 +115,81 @@ func hasDBSpatialite(db *sql.DB) bool {
   _, err := db.Exec("select spatialite_version();")
   return err == nil
 }
+
+// memoryConnector Type Helper: driver.Connector for ":memory:" dbs.
+type memoryConnector struct {
+  d driver.Driver
+}
+
+// Connect implements driver.Connector.
+func (mc memoryConnector) Connect(context.Context) (driver.Conn, error) {
+  return mc.d.Open(":memory:")
+}
+
+// Driver implements driver.Connector.
+func (mc memoryConnector) Driver() driver.Driver {
+  return mc.d
+}
+
+// openMemoryDB Helper: Open a pool of new (empty) in-memory sqlite
+// connections, with the same extensions (and custom GTFS sql functions)
+// as db, but without tracking them (see sqliteGTFSConns), since they're
+// opened concurrently by workers.
+// note: each connection is its own separate in-memory db!
+func openMemoryDB(db *sql.DB) *sql.DB {
+  d := &sqlite3.SQLiteDriver{ConnectHook: registerFunctions}
+  if src, ok := db.Driver().(*sqlite3.SQLiteDriver); ok {
+    d.Extensions = src.Extensions
+  }
+  return sql.OpenDB(memoryConnector{d})
+}
+
+// isStrIn Helper: Check if string is in list.
+func isStrIn(s string, list []string) bool {
+  for _, v := range list {
+    if v == s {
+      return true
+    }
+  }
+  return false
+}
+
+// getDBTableCols Helper: Get list of column names of table in sqlite db.
+func getDBTableCols(db *sql.DB, table string) ([]string, error) {
+  rows, qErr := db.Query(fmt.Sprintf("select * from %s limit 0;", table))
+  if qErr != nil {
+    return nil, fmt.Errorf("failed to query %s columns [%s]", table, qErr)
+  }
+  defer rows.Close()
+
+  return rows.Columns()
+}
+
+// hasDBTableCol Helper: Check if column exists in table in sqlite db.
+func hasDBTableCol(db *sql.DB, table, col string) bool {
+  cols, cErr := getDBTableCols(db, table)
+  return cErr == nil && isStrIn(col, cols)
+}
+
+// optDBTableCol Helper: Select expression of optional column in table
+// (with alias, if any), as empty string if null or missing.
+func optDBTableCol(db *sql.DB, alias, table, col string) string {
+  if hasDBTableCol(db, table, col) == false {
+    return "''"
+  }
+  if alias != "" {
+    col = alias + "." + col
+  }
+  return "coalesce(" + col + ", '')"
+}
+
+// requireSecsColumns Helper: Check derived "seconds" columns exist (added
+// on import), of stop_times, and frequencies (if any).
+func requireSecsColumns(db *sql.DB) error {
+  if hasDBTableCol(db, "stop_times", "departure_secs") == false ||
+     (hasDBTable(db, "frequencies") &&
+      hasDBTableCol(db, "frequencies", "start_secs") == false) {
+    return fmt.Errorf("missing derived seconds columns (re-import GTFS)")
+  }
+  return nil
+}
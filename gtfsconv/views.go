@@ -0,0 +1,105 @@
+package gtfsconv
+
+import (
+  "fmt"
+  "database/sql"
+)
+
+// createViews creates convenience views over GTFS tables
+// (only for views where all underlying tables exist):
+//
+//   trip_stops     each trip's stops, times and coordinates
+//   route_stops    distinct stops of each route/direction, with sequence
+//   stop_routes    routes serving each stop
+//   route_summary  trip counts, and first/last departure of each route
+//                  (with frequency-based runs, see "trip_instances")
+func createViews(db *sql.DB) error {
+
+  // trip runs (with each run of frequency-based trips, if expanded)
+  tripRuns := `select trip_id,
+      min(coalesce(departure_secs, arrival_secs)) as first_secs
+    from stop_times group by trip_id`
+  if hasDBTable(db, "trip_instances") {
+    tripRuns = `select template_trip_id as trip_id, start_secs as first_secs
+      from trip_instances`
+  }
+
+  views := []struct {
+    name    string
+    tables  []string  // required tables
+    query   string
+  }{
+    {"trip_stops", []string{"trips", "stop_times", "stops"}, fmt.Sprintf(`
+      select t.trip_id, t.route_id, t.service_id,
+        %s as direction_id, %s as trip_headsign,
+        cast(st.stop_sequence as int) as stop_sequence,
+        st.stop_id, s.stop_name,
+        cast(s.stop_lat as real) as stop_lat,
+        cast(s.stop_lon as real) as stop_lon,
+        st.arrival_time, st.departure_time,
+        st.arrival_secs, st.departure_secs
+      from trips t
+        join stop_times st on st.trip_id = t.trip_id
+        left join stops s on s.stop_id = st.stop_id`,
+      optDBTableCol(db, "t", "trips", "direction_id"),
+      optDBTableCol(db, "t", "trips", "trip_headsign"))},
+
+    {"route_stops", []string{"trips", "stop_times", "stops"}, fmt.Sprintf(`
+      select t.route_id, %s as direction_id, st.stop_id, s.stop_name,
+        min(cast(st.stop_sequence as int)) as stop_sequence,
+        count(distinct t.trip_id) as num_trips
+      from trips t
+        join stop_times st on st.trip_id = t.trip_id
+        left join stops s on s.stop_id = st.stop_id
+      group by t.route_id, %[1]s, st.stop_id`,
+      optDBTableCol(db, "t", "trips", "direction_id"))},
+
+    {"stop_routes", []string{"trips", "stop_times", "stops", "routes"},
+      fmt.Sprintf(`
+      select st.stop_id, s.stop_name, t.route_id,
+        %s as route_short_name, %s as route_long_name, r.route_type,
+        count(distinct t.trip_id) as num_trips
+      from stop_times st
+        join trips t on t.trip_id = st.trip_id
+        left join routes r on r.route_id = t.route_id
+        left join stops s on s.stop_id = st.stop_id
+      group by st.stop_id, t.route_id`,
+      optDBTableCol(db, "r", "routes", "route_short_name"),
+      optDBTableCol(db, "r", "routes", "route_long_name"))},
+
+    {"route_summary", []string{"trips", "stop_times", "routes"}, fmt.Sprintf(`
+      select r.route_id, %s as route_short_name, %s as route_long_name,
+        r.route_type, count(tt.trip_id) as num_trips,
+        min(tt.first_secs) as first_departure_secs,
+        max(tt.first_secs) as last_departure_secs,
+        %s as first_departure, %s as last_departure
+      from routes r
+        left join trips t on t.route_id = r.route_id
+        left join (%s) tt on tt.trip_id = t.trip_id
+      group by r.route_id`,
+      optDBTableCol(db, "r", "routes", "route_short_name"),
+      optDBTableCol(db, "r", "routes", "route_long_name"),
+      sqlGTFSTime("min(tt.first_secs)"), sqlGTFSTime("max(tt.first_secs)"),
+      tripRuns)},
+  }
+
+  for _, v := range views {
+
+    // only create view, if all underlying tables exist
+    hasTables := true
+    for _, t := range v.tables {
+      hasTables = hasTables && hasDBTable(db, t)
+    }
+    if hasTables == false {
+      continue
+    }
+
+    if _, cErr := db.Exec(fmt.Sprintf(
+      "drop view if exists %s; create view %s as %s;",
+      v.name, v.name, v.query)); cErr != nil {
+      return fmt.Errorf("failed to create view `%s` [%s]", v.name, cErr)
+    }
+  }
+
+  return nil
+}
@@ -4,6 +4,7 @@ import (
   "flag"
   "time"
   "log"
+  "strings"
   "github.com/harrytruong/gtfs-sqlite/gtfsconv"
 )
 
@@ -11,6 +12,29 @@ import (
 //      see gtfs.options
 var opt gtfsconv.Options
 
+// listFlag: flag.Value for a repeatable (or comma-separated) list flag
+type listFlag struct {
+  list *[]string
+}
+
+// String implements flag.Value.
+func (f listFlag) String() string {
+  if f.list == nil {
+    return ""
+  }
+  return strings.Join(*f.list, ",")
+}
+
+// Set implements flag.Value, appending each comma-separated value.
+func (f listFlag) Set(v string) error {
+  for _, item := range strings.Split(v, ",") {
+    if item = strings.TrimSpace(item); item != "" {
+      *f.list = append(*f.list, item)
+    }
+  }
+  return nil
+}
+
 // init parses CLI flags/args into "opt"
 func init() {
 
@@ -26,10 +50,66 @@ func init() {
     "Skip extra export file formats (csv, json, geojson, kml).")
   flag.BoolVar(&opt.Spatialite, "spatialite", opt.Spatialite,
     "Include spatialite-enabled sqlite tables.")
+  flag.StringVar(&opt.SpatialiteExt, "spatialite-ext", opt.SpatialiteExt,
+    "Spatialite extension path. (default: mod_spatialite, libspatialite)")
+  flag.Var(listFlag{&opt.Extensions}, "load-extension",
+    "Other sqlite extension(s) to load, path or name (repeat, or comma-separate).")
+  flag.BoolVar(&opt.Geometry, "geometry", opt.Geometry,
+    "Include geometry tables without spatialite (as geopackage).")
   flag.BoolVar(&opt.KeepDB, "keepdb", opt.KeepDB,
     "Reuse existing sqlite db, if exist.")
   flag.BoolVar(&opt.SkipClean, "skipclean", opt.SkipClean,
     "Skip applying agency-specific cleanup rules for irregular GTFS files.")
+  flag.BoolVar(&opt.Lenient, "lenient", opt.Lenient,
+    "Skip malformed GTFS rows (logged in gtfs_import_errors table).")
+  flag.IntVar(&opt.MaxErrors, "max-errors", opt.MaxErrors,
+    "Max skipped rows per GTFS file, with -lenient (0 = no max).")
+  flag.StringVar(&opt.StartDate, "start-date", opt.StartDate,
+    "Limit derived service dates from this date (YYYYMMDD).")
+  flag.StringVar(&opt.EndDate, "end-date", opt.EndDate,
+    "Limit derived service dates until this date (YYYYMMDD).")
+  flag.BoolVar(&opt.ExpandFrequencies, "expand-frequencies",
+    opt.ExpandFrequencies,
+    "Expand frequency-based trips into trip_instances, stop_times_expanded.")
+  flag.BoolVar(&opt.Interpolate, "interpolate", opt.Interpolate,
+    "Interpolate missing stop_times (e.g., non-timepoint stops).")
+  flag.BoolVar(&opt.GenerateShapes, "generate-shapes", opt.GenerateShapes,
+    "Generate straight-line shapes, for trips without shapes.")
+  flag.BoolVar(&opt.ProjectStops, "project-stops", opt.ProjectStops,
+    "Project stops onto shapes (fills blank shape_dist_traveled).")
+  flag.Float64Var(&opt.MaxStopOffset, "max-stop-offset", opt.MaxStopOffset,
+    "Flag stops farther from shape (in meters), with -project-stops.")
+  flag.Float64Var(&opt.ClusterStops, "cluster-stops", opt.ClusterStops,
+    "Cluster similarly named stops within radius (in meters).")
+  flag.Float64Var(&opt.ClusterSimilarity, "cluster-similarity",
+    opt.ClusterSimilarity,
+    "Min name similarity (0 to 1) of clustered stops, with -cluster-stops.")
+  flag.BoolVar(&opt.ClusterParents, "cluster-parents", opt.ClusterParents,
+    "Synthesize parent stations of stop clusters, with -cluster-stops.")
+  flag.Float64Var(&opt.Footpaths, "footpaths", opt.Footpaths,
+    "Generate walking transfers between stops within radius (in meters).")
+  flag.Float64Var(&opt.WalkSpeed, "walk-speed", opt.WalkSpeed,
+    "Walking speed (in m/s), for walking transfers.")
+  flag.BoolVar(&opt.Patterns, "patterns", opt.Patterns,
+    "Build trip patterns (trips grouped by exact stop sequence).")
+  flag.BoolVar(&opt.Segments, "segments", opt.Segments,
+    "Build stop-to-stop segments (distance, run times, speeds).")
+  flag.StringVar(&opt.Periods, "periods", opt.Periods,
+    "Time-of-day periods for segments, headways, as name=start-end,... (hours).")
+  flag.StringVar(&opt.Headways, "headways", opt.Headways,
+    "Build headways on service date (YYYYMMDD), or day type (e.g., weekday).")
+  flag.BoolVar(&opt.ScheduledEvents, "scheduled-events", opt.ScheduledEvents,
+    "Build UTC scheduled_events (requires -start-date and -end-date).")
+  flag.BoolVar(&opt.Search, "search", opt.Search,
+    "Build full-text search_index (requires -tags sqlite_fts5).")
+  flag.Float64Var(&opt.Simplify, "simplify", opt.Simplify,
+    "Simplify exported shapes, with tolerance in meters (0 = none).")
+  flag.StringVar(&opt.SimplifyMethod, "simplify-method", opt.SimplifyMethod,
+    "Shape simplification method: dp (douglas-peucker), vw (visvalingam).")
+  flag.IntVar(&opt.Precision, "precision", opt.Precision,
+    "Coordinate decimal places of exports (0 = full precision).")
+  flag.IntVar(&opt.Workers, "workers", opt.Workers,
+    "Max parallel workers (e.g., for spatialite routes_geo).")
 
   flag.Parse() // parse cli flags
 
@@ -38,6 +118,15 @@ func init() {
 
 // main runs gtfsconv from CLI.
 func main() {
+
+  // run CLI subcommand (against built sqlite db), if any
+  if _, isCmd := commands[flag.Arg(0)]; isCmd {
+    if cmdErr := runCommand(flag.Arg(0), flag.Args()[1:]); cmdErr != nil {
+      log.Fatalf("%s failed: %s", flag.Arg(0), cmdErr)
+    }
+    return
+  }
+
   start := time.Now()
 
   // starting build